@@ -0,0 +1,186 @@
+package optw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHandshakeTimeout = time.Second * 5
+	DefaultMaxHandshakes    = 128
+
+	// backoff of the accept retries
+	minAcceptDelay = time.Millisecond * 5
+	maxAcceptDelay = time.Second
+)
+
+var errListenerClosed = fmt.Errorf("optw: listener closed: %w", net.ErrClosed)
+
+// HandshakeConfig is embedded in the transport configs
+type HandshakeConfig struct {
+	// handshake timeout in seconds
+	HandshakeTimeout int `json:"handshakeTimeout"`
+	// max concurrent handshakes of a listener
+	MaxHandshakes int `json:"maxHandshakes"`
+	// timeout set by WithHandshakeTimeout
+	timeout time.Duration
+}
+
+var DefaultHandshakeConfig = HandshakeConfig{
+	HandshakeTimeout: int(DefaultHandshakeTimeout / time.Second),
+	MaxHandshakes:    DefaultMaxHandshakes,
+}
+
+// Timeout returns the handshake timeout, the default one if unset
+func (c HandshakeConfig) Timeout() time.Duration {
+	if c.timeout > 0 {
+		return c.timeout
+	}
+	if c.HandshakeTimeout <= 0 {
+		return DefaultHandshakeTimeout
+	}
+	return time.Second * time.Duration(c.HandshakeTimeout)
+}
+
+// Concurrency returns the max concurrent handshakes, the default one if unset
+func (c HandshakeConfig) Concurrency() int {
+	if c.MaxHandshakes <= 0 {
+		return DefaultMaxHandshakes
+	}
+	return c.MaxHandshakes
+}
+
+// Acceptor runs the handshakes of accepted connections in background
+// so that a slow or silent client does not stall Accept.
+// Listeners run Serve once listening and drain Accept.
+type Acceptor struct {
+	// ready holds the handshaked connections, a slot is released
+	// once its connection is accepted, so ready never blocks
+	ready  chan acceptResult
+	slots  chan struct{}
+	done   chan struct{}
+	err    error
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+type acceptResult struct {
+	conn Conn
+	err  error
+}
+
+// NewAcceptor creates an acceptor running at most maxHandshakes handshakes
+func NewAcceptor(maxHandshakes int) *Acceptor {
+	return &Acceptor{
+		ready:  make(chan acceptResult, maxHandshakes),
+		slots:  make(chan struct{}, maxHandshakes),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// Serve runs the accept loop until the listener or the acceptor is closed.
+// accept waits for the next raw connection and returns its handshake,
+// its errors other than net.ErrClosed are retried with a capped backoff.
+func (a *Acceptor) Serve(accept func() (handshake func() (Conn, error), err error)) {
+	defer close(a.done)
+	var delay time.Duration
+	for {
+		select {
+		case a.slots <- struct{}{}:
+		case <-a.closed:
+			a.err = errListenerClosed
+			return
+		}
+
+		handshake, err := accept()
+		if errors.Is(err, net.ErrClosed) {
+			a.err = err
+			return
+		}
+		if err != nil {
+			<-a.slots
+			delay = min(max(delay*2, minAcceptDelay), maxAcceptDelay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-a.closed:
+				a.err = errListenerClosed
+				return
+			}
+		}
+		delay = 0
+
+		go func() {
+			conn, err := handshake()
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			select {
+			case <-a.closed:
+				<-a.slots
+				if conn != nil {
+					conn.Close()
+				}
+			default:
+				a.ready <- acceptResult{conn: conn, err: err}
+			}
+		}()
+	}
+}
+
+// Accept returns the next handshaked connection,
+// a failed handshake is returned as error and the acceptor keeps serving.
+func (a *Acceptor) Accept() (Conn, error) {
+	return a.AcceptContext(context.Background())
+}
+
+// AcceptContext is Accept giving up once ctx is done
+func (a *Acceptor) AcceptContext(ctx context.Context) (Conn, error) {
+	// handshaked connections go first, select picks at random
+	select {
+	case r := <-a.ready:
+		<-a.slots
+		return r.conn, r.err
+	default:
+	}
+
+	select {
+	case r := <-a.ready:
+		<-a.slots
+		return r.conn, r.err
+	case <-a.done:
+		return nil, a.err
+	case <-a.closed:
+		return nil, errListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops serving, connections not accepted yet are closed
+func (a *Acceptor) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.closed:
+		return
+	default:
+	}
+
+	close(a.closed)
+	for {
+		select {
+		case r := <-a.ready:
+			<-a.slots
+			if r.conn != nil {
+				r.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package optw
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smartystreets/goconvey/convey"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAcceptor(t *testing.T) {
+	convey.Convey("test handshaked conns are accepted after listener fails", t, func() {
+		for i := 0; i < 32; i++ {
+			a := NewAcceptor(4)
+			calls := 0
+			go a.Serve(func() (func() (Conn, error), error) {
+				calls++
+				if calls > 1 {
+					// fail once the handshaked conn is ready
+					for len(a.ready) == 0 {
+						time.Sleep(time.Millisecond)
+					}
+					return nil, fmt.Errorf("listener fail: %w", net.ErrClosed)
+				}
+				return func() (Conn, error) {
+					return newFakeConn(), nil
+				}, nil
+			})
+			<-a.done
+
+			conn, err := a.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(conn, convey.ShouldNotBeNil)
+			_, err = a.Accept()
+			convey.So(errors.Is(err, net.ErrClosed), convey.ShouldBeTrue)
+			a.Close()
+		}
+	})
+
+	convey.Convey("test accepting continues after a temporary error", t, func() {
+		a := NewAcceptor(4)
+		defer a.Close()
+		calls := 0
+		go a.Serve(func() (func() (Conn, error), error) {
+			calls++
+			if calls == 1 {
+				return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+			}
+			return func() (Conn, error) {
+				return newFakeConn(), nil
+			}, nil
+		})
+
+		conn, err := a.Accept()
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(conn, convey.ShouldNotBeNil)
+		conn.Close()
+
+		a.Close()
+		<-a.done
+		_, err = a.Accept()
+		convey.So(errors.Is(err, net.ErrClosed), convey.ShouldBeTrue)
+	})
+}
@@ -0,0 +1,567 @@
+package optw
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+)
+
+// auth handshake version 2, challenge-response with mutual proof.
+// the client speaks first, a zero length prefix tells it apart from
+// the legacy framing which starts with the non zero token length.
+//
+//	client hello:     | 0x0000 | version 1 | client nonce 16 |
+//	server challenge: | version 1 | server nonce 16 |
+//	client proof:     | hmac(token, client label, client nonce, server nonce, metadata) 32 |
+//	                  | metadata length 2 | metadata |
+//	server reply:     | status 1 | hmac(token, server label, client nonce, server nonce) 32 |
+//
+// the server proof is only sent with authOK.
+//
+// the proof is keyed with the secret of the client when the server has a
+// secret func and the client sends its key id in the metadata, with the
+// access token otherwise.
+//
+// a server without secret for the client can not verify the proof, eg: one with an
+// auth func only. it replies authNoSecret, which is not authenticated, so the
+// client fails unless legacy auth is enabled on the dialer. with it the client
+// falls back to sending its token in plaintext, as the legacy framing does:
+//
+//	server reply:     | authNoSecret 1 |
+//	client token:     | token length 2 | token |
+//	server reply:     | status 1 |
+//
+// metadata is encoded as
+//
+//	| key length 2 | key | value length 2 | value | ...
+//
+// legacy framing, the token is sent in plaintext and echoed back:
+//
+//	| token length 2 | token |
+const (
+	authVersion = 2
+	nonceSize   = 16
+	proofSize   = sha256.Size
+
+	authOK       = 0
+	authFail     = 1
+	authNoSecret = 2
+)
+
+// MetadataKeyID is the metadata key of the client key id, a listener
+// with a secret func verifies the client with the secret of its key id
+const MetadataKeyID = "optw-key-id"
+
+var (
+	clientProofLabel = []byte("optw client proof")
+	serverProofLabel = []byte("optw server proof")
+
+	errLegacyAuth = fmt.Errorf("%w: legacy auth is disabled", ErrAuthFailed)
+	errNoSecret   = fmt.Errorf("%w: the server has no secret to verify the proof, "+
+		"enable legacy auth on the dialer to send the token in plaintext", ErrAuthFailed)
+)
+
+// AuthInfo describes the client being authenticated
+type AuthInfo struct {
+	// Token is the verified access token or client secret,
+	// or the plaintext one sent by legacy clients
+	Token string
+	// KeyID is the client key id sent in the metadata,
+	// verified if the listener has a secret func
+	KeyID      string
+	RemoteAddr net.Addr
+	// Scheme is the transport scheme, eg: kcp, mux, quic
+	Scheme string
+	// Metadata is sent by the client, eg: client id, version
+	Metadata map[string]string
+	// Certificate is the verified tls client certificate, nil without mTLS
+	Certificate *x509.Certificate
+	// Identity is the certificate subject or SAN, see CertIdentity
+	Identity string
+	// PeerCred is the process of a unix socket client,
+	// nil on other networks and on platforms without SO_PEERCRED
+	PeerCred *PeerCred
+}
+
+// PeerCred is the credentials of a unix socket peer process
+type PeerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// SecretFunc returns the secret of the client with key id, the client
+// sends it as access token. An error rejects the client.
+type SecretFunc func(keyID string) (secret string, err error)
+
+// AuthHandler authenticates a client, the returned identity
+// is exposed by the accepted Conn.
+// Returning an error rejects the client.
+type AuthHandler func(info *AuthInfo) (identity interface{}, err error)
+
+// ServerAuth holds the server side auth settings,
+// listeners embed it to implement the auth setters of Listener.
+type ServerAuth struct {
+	token    string
+	authFn   func(token string) bool
+	secretFn SecretFunc
+	handler  AuthHandler
+	legacy   bool
+}
+
+// SetAccessToken sets the token shared with the clients,
+// it enables the challenge-response handshake.
+func (a *ServerAuth) SetAccessToken(token string) {
+	a.token = token
+}
+
+// SetAuthFunc sets a check of the plaintext tokens, sent by legacy clients
+// or by dialers with legacy auth enabled to a listener without access token.
+func (a *ServerAuth) SetAuthFunc(f func(token string) bool) {
+	a.authFn = f
+}
+
+// SetSecretFunc sets the lookup of per client secrets, clients send their
+// key id as MetadataKeyID and their secret as access token.
+// Clients without key id are verified with the access token.
+func (a *ServerAuth) SetSecretFunc(f SecretFunc) {
+	a.secretFn = f
+}
+
+// SetAuthHandler sets the client authentication callback,
+// it runs after the token is verified.
+func (a *ServerAuth) SetAuthHandler(h AuthHandler) {
+	a.handler = h
+}
+
+// SetLegacyAuth enables the legacy plaintext token framing
+// for clients not upgraded yet
+func (a *ServerAuth) SetLegacyAuth(enable bool) {
+	a.legacy = enable
+}
+
+// Enabled reports whether clients must authenticate
+func (a *ServerAuth) Enabled() bool {
+	return a.TokenEnabled() || a.handler != nil
+}
+
+// TokenEnabled reports whether clients must send a token,
+// a handler alone also accepts clients verified by their transport.
+func (a *ServerAuth) TokenEnabled() bool {
+	return len(a.token) > 0 || a.authFn != nil || a.secretFn != nil
+}
+
+// HandlerEnabled reports whether an auth handler is set
+func (a *ServerAuth) HandlerEnabled() bool {
+	return a.handler != nil
+}
+
+// VerifyToken reports whether token passes the access token and auth func
+// checks, for transports carrying the token themselves, eg: ssh password.
+func (a *ServerAuth) VerifyToken(token string) bool {
+	return a.checkToken(token, nil)
+}
+
+func (a *ServerAuth) allowLegacy() bool {
+	return a.legacy || len(a.token) <= 0
+}
+
+// secret returns the secret of the client with metadata md,
+// ok is false if the server has none for it
+func (a *ServerAuth) secret(md map[string]string) (secret string, ok bool, err error) {
+	if keyID, found := md[MetadataKeyID]; found && a.secretFn != nil {
+		secret, err := a.secretFn(keyID)
+		if err != nil {
+			return "", false, fmt.Errorf("%w: key id %s: %w", ErrAuthFailed, keyID, err)
+		}
+		return secret, true, nil
+	}
+	if len(a.token) > 0 {
+		return a.token, true, nil
+	}
+	return "", false, nil
+}
+
+// checkToken reports whether the plaintext token of the client with
+// metadata md is its secret and passes the auth func, a listener
+// without token checks leaves it to the auth handler
+func (a *ServerAuth) checkToken(token string, md map[string]string) bool {
+	secret, ok, err := a.secret(md)
+	if err != nil {
+		return false
+	}
+	if !ok && a.authFn == nil {
+		return !a.TokenEnabled() && a.handler != nil
+	}
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return false
+	}
+	if a.authFn != nil && !a.authFn(token) {
+		return false
+	}
+	return true
+}
+
+// authenticate runs the auth callback for a verified token,
+// the identity is the transport one without callback.
+func (a *ServerAuth) authenticate(info *AuthInfo) (interface{}, error) {
+	if a.handler == nil {
+		if len(info.Identity) > 0 {
+			return info.Identity, nil
+		}
+		return nil, nil
+	}
+
+	identity, err := a.handler(info)
+	if err != nil {
+		return nil, fmt.Errorf("%w: auth handler reject: %w", ErrAuthFailed, err)
+	}
+	return identity, nil
+}
+
+func proof(token string, label, clientNonce, serverNonce, metadata []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(label)
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	mac.Write(metadata)
+	return mac.Sum(nil)
+}
+
+func encodeMetadata(md map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 0)
+	for _, k := range keys {
+		for _, field := range []string{k, md[k]} {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(field)))
+			buf = append(buf, field...)
+		}
+	}
+
+	if len(buf) > math.MaxUint16 {
+		return nil, fmt.Errorf("metadata too large: %d bytes", len(buf))
+	}
+	return buf, nil
+}
+
+func decodeMetadata(buf []byte) (map[string]string, error) {
+	md := make(map[string]string)
+	fields := make([]string, 0, 2)
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return nil, fmt.Errorf("invalid metadata")
+		}
+		n := int(binary.BigEndian.Uint16(buf))
+		buf = buf[2:]
+		if len(buf) < n {
+			return nil, fmt.Errorf("invalid metadata")
+		}
+		fields = append(fields, string(buf[:n]))
+		buf = buf[n:]
+
+		if len(fields) == 2 {
+			md[fields[0]] = fields[1]
+			fields = fields[:0]
+		}
+	}
+
+	if len(fields) != 0 {
+		return nil, fmt.Errorf("invalid metadata")
+	}
+	return md, nil
+}
+
+// AuthRequest runs the client side of the auth handshake,
+// it fails if the server can not prove it knows the token too.
+// md is sent to the server along with the proof, it may be nil.
+func AuthRequest(conn io.ReadWriter, token string, md map[string]string) error {
+	return authRequest(conn, token, md, false)
+}
+
+// LegacyAuthRequest is AuthRequest falling back to sending the token in
+// plaintext to a server without secret for the client, eg: one with an
+// auth func only. The fallback has no proof of the server.
+func LegacyAuthRequest(conn io.ReadWriter, token string, md map[string]string) error {
+	return authRequest(conn, token, md, true)
+}
+
+func authRequest(conn io.ReadWriter, token string, md map[string]string, legacy bool) error {
+	metadata, err := encodeMetadata(md)
+	if err != nil {
+		return err
+	}
+
+	clientNonce := make([]byte, nonceSize)
+	_, err = rand.Read(clientNonce)
+	if err != nil {
+		return err
+	}
+
+	hello := make([]byte, 3, 3+nonceSize)
+	hello[2] = authVersion
+	_, err = conn.Write(append(hello, clientNonce...))
+	if err != nil {
+		return err
+	}
+
+	// read challenge
+	challenge := make([]byte, 1+nonceSize)
+	_, err = io.ReadFull(conn, challenge)
+	if err != nil {
+		return fmt.Errorf("read auth challenge fail: %w", err)
+	}
+	if challenge[0] != authVersion {
+		return fmt.Errorf("unsupported auth version %d", challenge[0])
+	}
+	serverNonce := challenge[1:]
+
+	clientProof := proof(token, clientProofLabel, clientNonce, serverNonce, metadata)
+	clientProof = binary.BigEndian.AppendUint16(clientProof, uint16(len(metadata)))
+	_, err = conn.Write(append(clientProof, metadata...))
+	if err != nil {
+		return err
+	}
+
+	// read auth reply
+	status := make([]byte, 1)
+	_, err = io.ReadFull(conn, status)
+	if err != nil {
+		return fmt.Errorf("read auth reply fail: %w", err)
+	}
+
+	switch status[0] {
+	case authOK:
+	case authNoSecret:
+		if !legacy {
+			return errNoSecret
+		}
+		return fallbackAuthRequest(conn, token)
+	default:
+		return fmt.Errorf("%w: rejected by server", ErrAuthFailed)
+	}
+
+	serverProof := make([]byte, proofSize)
+	_, err = io.ReadFull(conn, serverProof)
+	if err != nil {
+		return fmt.Errorf("read server proof fail: %w", err)
+	}
+
+	if !hmac.Equal(serverProof, proof(token, serverProofLabel, clientNonce, serverNonce, nil)) {
+		return fmt.Errorf("%w: verify server proof fail", ErrAuthFailed)
+	}
+	return nil
+}
+
+// fallbackAuthRequest sends the token in plaintext
+// to a server which has no secret to verify the proof
+func fallbackAuthRequest(conn io.ReadWriter, token string) error {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(token)))
+	_, err := conn.Write(append(buf, token...))
+	if err != nil {
+		return err
+	}
+
+	status := make([]byte, 1)
+	_, err = io.ReadFull(conn, status)
+	if err != nil {
+		return fmt.Errorf("read auth reply fail: %w", err)
+	}
+	if status[0] != authOK {
+		return fmt.Errorf("%w: rejected by server", ErrAuthFailed)
+	}
+	return nil
+}
+
+// VerifyPeer authenticates a client verified by its transport,
+// eg: by its tls client certificate or unix peer credentials, without token handshake.
+// It returns the identity from the auth handler, or info.Identity without handler.
+func VerifyPeer(auth *ServerAuth, info *AuthInfo) (interface{}, error) {
+	return auth.authenticate(info)
+}
+
+// CertIdentity returns the subject common name of cert,
+// or its first SAN if it has none
+func CertIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.Subject.CommonName) > 0:
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.IPAddresses) > 0:
+		return cert.IPAddresses[0].String()
+	}
+	return ""
+}
+
+// VerifyAuth runs the server side of the auth handshake,
+// info carries the transport details of the client, the token is filled in.
+// It returns the identity from the auth handler.
+func VerifyAuth(conn io.ReadWriter, auth *ServerAuth, info *AuthInfo) (interface{}, error) {
+	hdr := make([]byte, 2)
+	_, err := io.ReadFull(conn, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("read auth hdr fail: %w", err)
+	}
+
+	tokenLen := binary.BigEndian.Uint16(hdr)
+	if tokenLen > 0 {
+		return verifyLegacyAuth(conn, auth, info, hdr)
+	}
+
+	hello := make([]byte, 1+nonceSize)
+	_, err = io.ReadFull(conn, hello)
+	if err != nil {
+		return nil, fmt.Errorf("read auth hello fail: %w", err)
+	}
+	version := hello[0]
+	if version != authVersion {
+		return nil, fmt.Errorf("unsupported auth version %d", version)
+	}
+	clientNonce := hello[1:]
+
+	serverNonce := make([]byte, nonceSize)
+	_, err = rand.Read(serverNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append([]byte{version}, serverNonce...))
+	if err != nil {
+		return nil, fmt.Errorf("write auth challenge fail: %w", err)
+	}
+
+	clientProof := make([]byte, proofSize)
+	_, err = io.ReadFull(conn, clientProof)
+	if err != nil {
+		return nil, fmt.Errorf("read client proof fail: %w", err)
+	}
+
+	_, err = io.ReadFull(conn, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("read metadata hdr fail: %w", err)
+	}
+
+	metadata := make([]byte, binary.BigEndian.Uint16(hdr))
+	_, err = io.ReadFull(conn, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("read metadata fail: %w", err)
+	}
+
+	md, err := decodeMetadata(metadata)
+	if err != nil {
+		conn.Write([]byte{authFail})
+		return nil, err
+	}
+
+	info.KeyID = md[MetadataKeyID]
+	secret, ok, err := auth.secret(md)
+	if err != nil {
+		conn.Write([]byte{authFail})
+		return nil, err
+	}
+	if !ok {
+		conn.Write([]byte{authNoSecret})
+		return verifyFallbackAuth(conn, auth, info, md)
+	}
+
+	if !hmac.Equal(clientProof, proof(secret, clientProofLabel, clientNonce, serverNonce, metadata)) {
+		conn.Write([]byte{authFail})
+		return nil, fmt.Errorf("%w: verify client proof fail", ErrAuthFailed)
+	}
+
+	info.Token = secret
+	info.Metadata = md
+	identity, err := auth.authenticate(info)
+	if err != nil {
+		conn.Write([]byte{authFail})
+		return nil, err
+	}
+
+	reply := append([]byte{authOK}, proof(secret, serverProofLabel, clientNonce, serverNonce, nil)...)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, fmt.Errorf("write auth reply fail: %w", err)
+	}
+	return identity, nil
+}
+
+// verifyFallbackAuth checks the plaintext token of a client
+// which fell back from the proof
+func verifyFallbackAuth(conn io.ReadWriter, auth *ServerAuth, info *AuthInfo, md map[string]string) (interface{}, error) {
+	hdr := make([]byte, 2)
+	_, err := io.ReadFull(conn, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("read access token hdr fail: %w", err)
+	}
+	token := make([]byte, binary.BigEndian.Uint16(hdr))
+	_, err = io.ReadFull(conn, token)
+	if err != nil {
+		return nil, fmt.Errorf("read access token fail: %w", err)
+	}
+
+	if !auth.checkToken(string(token), md) {
+		conn.Write([]byte{authFail})
+		return nil, fmt.Errorf("%w: verify token fail", ErrAuthFailed)
+	}
+
+	info.Token = string(token)
+	info.Metadata = md
+	identity, err := auth.authenticate(info)
+	if err != nil {
+		conn.Write([]byte{authFail})
+		return nil, err
+	}
+
+	_, err = conn.Write([]byte{authOK})
+	if err != nil {
+		return nil, fmt.Errorf("write auth reply fail: %w", err)
+	}
+	return identity, nil
+}
+
+func verifyLegacyAuth(conn io.ReadWriter, auth *ServerAuth, info *AuthInfo, hdr []byte) (interface{}, error) {
+	if !auth.allowLegacy() {
+		return nil, errLegacyAuth
+	}
+
+	tokenLen := binary.BigEndian.Uint16(hdr)
+	token := make([]byte, tokenLen)
+	_, err := io.ReadFull(conn, token)
+	if err != nil {
+		return nil, fmt.Errorf("read access token fail: %w", err)
+	}
+
+	if !auth.checkToken(string(token), nil) {
+		return nil, fmt.Errorf("%w: verify token fail", ErrAuthFailed)
+	}
+
+	info.Token = string(token)
+	info.Metadata = make(map[string]string)
+	identity, err := auth.authenticate(info)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(hdr, token...))
+	if err != nil {
+		return nil, fmt.Errorf("write auth reply fail: %w", err)
+	}
+	return identity, nil
+}
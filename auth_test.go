@@ -0,0 +1,321 @@
+package optw
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+)
+
+func runAuth(auth *ServerAuth, client func(conn net.Conn) error) (clientErr, serverErr error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := VerifyAuth(s, auth, &AuthInfo{RemoteAddr: s.RemoteAddr(), Scheme: "pipe"})
+		s.Close()
+		done <- err
+	}()
+	clientErr = client(c)
+	c.Close()
+	return clientErr, <-done
+}
+
+func legacyAuthRequest(conn net.Conn, token string) error {
+	hdr := make([]byte, 2)
+	binary.BigEndian.PutUint16(hdr, uint16(len(token)))
+	_, err := conn.Write(append(hdr, token...))
+	if err != nil {
+		return err
+	}
+
+	reply := make([]byte, len(hdr)+len(token))
+	_, err = io.ReadFull(conn, reply)
+	return err
+}
+
+func TestAuth(t *testing.T) {
+	convey.Convey("test auth handshake", t, func() {
+		convey.Convey("test challenge response success", func() {
+			auth := &ServerAuth{}
+			auth.SetAccessToken("test auth")
+			clientErr, serverErr := runAuth(auth, func(conn net.Conn) error {
+				return AuthRequest(conn, "test auth", nil)
+			})
+			convey.So(clientErr, convey.ShouldBeNil)
+			convey.So(serverErr, convey.ShouldBeNil)
+		})
+
+		convey.Convey("test challenge response fail", func() {
+			auth := &ServerAuth{}
+			auth.SetAccessToken("test auth")
+			clientErr, serverErr := runAuth(auth, func(conn net.Conn) error {
+				return AuthRequest(conn, "invalid test auth", nil)
+			})
+			convey.So(errors.Is(clientErr, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(serverErr, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test auth func checks plaintext tokens only", func() {
+			auth := &ServerAuth{}
+			auth.SetAccessToken("test auth")
+			auth.SetLegacyAuth(true)
+			auth.SetAuthFunc(func(token string) bool { return false })
+			clientErr, serverErr := runAuth(auth, func(conn net.Conn) error {
+				return AuthRequest(conn, "test auth", nil)
+			})
+			convey.So(clientErr, convey.ShouldBeNil)
+			convey.So(serverErr, convey.ShouldBeNil)
+
+			clientErr, serverErr = runAuth(auth, func(conn net.Conn) error {
+				return legacyAuthRequest(conn, "test auth")
+			})
+			convey.So(clientErr, convey.ShouldNotBeNil)
+			convey.So(errors.Is(serverErr, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test server without access token", func() {
+			auth := &ServerAuth{}
+			auth.SetAuthFunc(func(token string) bool { return token == "test auth" })
+			auth.SetAuthHandler(func(info *AuthInfo) (interface{}, error) {
+				return info.Token, nil
+			})
+
+			// no plaintext fallback unless legacy auth is enabled
+			clientErr, serverErr := runAuth(auth, func(conn net.Conn) error {
+				return AuthRequest(conn, "test auth", nil)
+			})
+			convey.So(errors.Is(clientErr, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(serverErr, convey.ShouldNotBeNil)
+
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			go LegacyAuthRequest(c, "test auth", map[string]string{"clientId": "client-1"})
+			info := &AuthInfo{}
+			identity, err := VerifyAuth(s, auth, info)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(identity, convey.ShouldEqual, "test auth")
+			convey.So(info.Metadata["clientId"], convey.ShouldEqual, "client-1")
+
+			clientErr, serverErr = runAuth(auth, func(conn net.Conn) error {
+				return LegacyAuthRequest(conn, "invalid test auth", nil)
+			})
+			convey.So(errors.Is(clientErr, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(serverErr, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test server can not prove the token", func() {
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			go func() {
+				// fake server accepts any proof
+				buf := make([]byte, 3+nonceSize)
+				io.ReadFull(s, buf)
+				s.Write(append([]byte{authVersion}, make([]byte, nonceSize)...))
+				io.ReadFull(s, make([]byte, proofSize+2))
+				s.Write(append([]byte{authOK}, make([]byte, proofSize)...))
+			}()
+			err := AuthRequest(c, "test auth", nil)
+			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(err.Error(), convey.ShouldContainSubstring, "server proof")
+		})
+
+		convey.Convey("test legacy framing", func() {
+			auth := &ServerAuth{}
+			auth.SetAccessToken("test auth")
+			clientErr, serverErr := runAuth(auth, func(conn net.Conn) error {
+				return legacyAuthRequest(conn, "test auth")
+			})
+			convey.So(clientErr, convey.ShouldNotBeNil)
+			convey.So(serverErr, convey.ShouldEqual, errLegacyAuth)
+
+			auth.SetLegacyAuth(true)
+			clientErr, serverErr = runAuth(auth, func(conn net.Conn) error {
+				return legacyAuthRequest(conn, "test auth")
+			})
+			convey.So(clientErr, convey.ShouldBeNil)
+			convey.So(serverErr, convey.ShouldBeNil)
+
+			clientErr, serverErr = runAuth(auth, func(conn net.Conn) error {
+				return legacyAuthRequest(conn, "invalid test auth")
+			})
+			convey.So(clientErr, convey.ShouldNotBeNil)
+			convey.So(serverErr, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test legacy framing with auth func only", func() {
+			auth := &ServerAuth{}
+			auth.SetAuthFunc(func(token string) bool { return token == "test auth" })
+			clientErr, serverErr := runAuth(auth, func(conn net.Conn) error {
+				return legacyAuthRequest(conn, "test auth")
+			})
+			convey.So(clientErr, convey.ShouldBeNil)
+			convey.So(serverErr, convey.ShouldBeNil)
+		})
+
+		convey.Convey("test auth handler", func() {
+			auth := &ServerAuth{}
+			auth.SetAccessToken("test auth")
+			auth.SetAuthHandler(func(info *AuthInfo) (interface{}, error) {
+				if info.Token != "test auth" || info.Scheme != "pipe" || info.RemoteAddr == nil {
+					return nil, fmt.Errorf("unexpected auth info %+v", info)
+				}
+				return "tenant-1", nil
+			})
+
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			go AuthRequest(c, "test auth", nil)
+			identity, err := VerifyAuth(s, auth, &AuthInfo{RemoteAddr: s.RemoteAddr(), Scheme: "pipe"})
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(identity, convey.ShouldEqual, "tenant-1")
+		})
+
+		convey.Convey("test per client secrets", func() {
+			secrets := map[string]string{"tenant-1": "secret 1", "tenant-2": "secret 2"}
+			auth := &ServerAuth{}
+			auth.SetSecretFunc(func(keyID string) (string, error) {
+				secret, ok := secrets[keyID]
+				if !ok {
+					return "", fmt.Errorf("unknown key id")
+				}
+				return secret, nil
+			})
+			auth.SetAuthHandler(func(info *AuthInfo) (interface{}, error) {
+				return info.KeyID, nil
+			})
+
+			verify := func(keyID, secret string) (interface{}, error) {
+				c, s := net.Pipe()
+				defer c.Close()
+				defer s.Close()
+				go AuthRequest(c, secret, map[string]string{MetadataKeyID: keyID})
+				return VerifyAuth(s, auth, &AuthInfo{})
+			}
+
+			identity, err := verify("tenant-1", "secret 1")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(identity, convey.ShouldEqual, "tenant-1")
+			identity, err = verify("tenant-2", "secret 2")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(identity, convey.ShouldEqual, "tenant-2")
+
+			// a tenant can not claim the key id of another one
+			_, err = verify("tenant-2", "secret 1")
+			convey.So(errors.Is(err, ErrAuthFailed), convey.ShouldBeTrue)
+			_, err = verify("tenant-3", "secret 1")
+			convey.So(errors.Is(err, ErrAuthFailed), convey.ShouldBeTrue)
+
+			// without key id and access token the secret can not be checked
+			clientErr, serverErr := runAuth(auth, func(conn net.Conn) error {
+				return LegacyAuthRequest(conn, "secret 1", nil)
+			})
+			convey.So(errors.Is(clientErr, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(serverErr, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test auth handler reject", func() {
+			auth := &ServerAuth{}
+			auth.SetAccessToken("test auth")
+			auth.SetAuthHandler(func(info *AuthInfo) (interface{}, error) {
+				return nil, fmt.Errorf("tenant disabled")
+			})
+			clientErr, serverErr := runAuth(auth, func(conn net.Conn) error {
+				return AuthRequest(conn, "test auth", nil)
+			})
+			convey.So(clientErr, convey.ShouldNotBeNil)
+			convey.So(serverErr.Error(), convey.ShouldContainSubstring, "tenant disabled")
+		})
+
+		convey.Convey("test metadata", func() {
+			auth := &ServerAuth{}
+			auth.SetAccessToken("test auth")
+			md := map[string]string{"clientId": "client-1", "version": "1.0.0", "caps": ""}
+			auth.SetAuthHandler(func(info *AuthInfo) (interface{}, error) {
+				return info.Metadata["clientId"], nil
+			})
+
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			go AuthRequest(c, "test auth", md)
+			info := &AuthInfo{}
+			identity, err := VerifyAuth(s, auth, info)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(identity, convey.ShouldEqual, "client-1")
+			convey.So(info.Metadata, convey.ShouldResemble, md)
+		})
+
+		convey.Convey("test tampered metadata", func() {
+			buf, err := encodeMetadata(map[string]string{"clientId": "client-1"})
+			convey.So(err, convey.ShouldBeNil)
+			_, err = decodeMetadata(buf[:len(buf)-1])
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = encodeMetadata(map[string]string{"big": string(make([]byte, 70000))})
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test unknown version", func() {
+			auth := &ServerAuth{}
+			auth.SetAccessToken("test auth")
+			_, serverErr := runAuth(auth, func(conn net.Conn) error {
+				_, err := conn.Write(append([]byte{0, 0, 1}, make([]byte, nonceSize)...))
+				return err
+			})
+			convey.So(serverErr, convey.ShouldNotBeNil)
+			convey.So(serverErr.Error(), convey.ShouldContainSubstring, "unsupported auth version")
+		})
+
+		convey.Convey("test fake server downgrade", func() {
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			tokens := make(chan []byte, 1)
+			go func() {
+				// fake server asks for the plaintext token
+				io.ReadFull(s, make([]byte, 3+nonceSize))
+				s.Write(append([]byte{authVersion}, make([]byte, nonceSize)...))
+				io.ReadFull(s, make([]byte, proofSize+2))
+				s.Write([]byte{authNoSecret})
+				buf, _ := io.ReadAll(s)
+				tokens <- buf
+			}()
+			err := AuthRequest(c, "test auth", nil)
+			convey.So(errors.Is(err, ErrAuthFailed), convey.ShouldBeTrue)
+			c.Close()
+			convey.So(<-tokens, convey.ShouldBeEmpty)
+		})
+
+		convey.Convey("test verify peer", func() {
+			certPEM, _, err := GenerateCertificate([]string{"client-1"})
+			convey.So(err, convey.ShouldBeNil)
+			block, _ := pem.Decode(certPEM)
+			cert, err := x509.ParseCertificate(block.Bytes)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(CertIdentity(cert), convey.ShouldEqual, "client-1")
+
+			auth := &ServerAuth{}
+			info := &AuthInfo{Certificate: cert, Identity: CertIdentity(cert)}
+			identity, err := VerifyPeer(auth, info)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(identity, convey.ShouldEqual, "client-1")
+
+			auth.SetAuthHandler(func(info *AuthInfo) (interface{}, error) {
+				return nil, fmt.Errorf("unknown client %s", info.Identity)
+			})
+			_, err = VerifyPeer(auth, info)
+			convey.So(errors.Is(err, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,160 @@
+package optw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is a transport specific configuration.
+// Decode lays the configuration over v, which is a pointer to the
+// transport config struct holding its defaults,
+// fields are matched by json tag name and unknown keys are errors.
+type Config interface {
+	Decode(v interface{}) error
+}
+
+// JSONConfig is a Config in json form, an empty JSONConfig keeps the defaults
+type JSONConfig json.RawMessage
+
+func (c JSONConfig) Decode(v interface{}) error {
+	if len(bytes.TrimSpace(c)) <= 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(c))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("decode config fail: %v", err)
+	}
+	return nil
+}
+
+// ParamsConfig is a Config in url query form, eg: mtu=1200&ackNoDelay=true.
+// Slice fields accept repeated or comma separated values,
+// time.Duration fields accept time.ParseDuration strings.
+type ParamsConfig url.Values
+
+func (c ParamsConfig) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("decode config fail: %T is not a struct pointer", v)
+	}
+
+	fields := make(map[string]reflect.Value)
+	collectFields(rv.Elem(), fields)
+	for key, values := range c {
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("decode config fail: unknown parameter %s", key)
+		}
+
+		err := setField(field, values)
+		if err != nil {
+			return fmt.Errorf("decode config fail: parameter %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// collectFields indexes the settable fields of a struct by json tag name,
+// embedded structs are flattened the same way encoding/json does.
+func collectFields(rv reflect.Value, fields map[string]reflect.Value) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		tag := sf.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			collectFields(rv.Field(i), fields)
+			continue
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields[name] = rv.Field(i)
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Slice {
+		elems := make([]string, 0, len(values))
+		for _, value := range values {
+			elems = append(elems, strings.Split(value, ",")...)
+		}
+
+		slice := reflect.MakeSlice(field.Type(), len(elems), len(elems))
+		for i, elem := range elems {
+			err := setValue(slice.Index(i), elem)
+			if err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+
+	if len(values) != 1 {
+		return fmt.Errorf("expect one value, got %d", len(values))
+	}
+	return setValue(field, values[0])
+}
+
+func setValue(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
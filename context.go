@@ -0,0 +1,210 @@
+package optw
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ContextError returns err with the ctx error in its chain once ctx is done,
+// so that a handshake interrupted by ctx reports context.Canceled
+// or context.DeadlineExceeded
+func ContextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	return Wrap(ctx.Err(), err)
+}
+
+// WithContext binds the handshake of conn to ctx, the deadlines set
+// on the returned conn are capped by the ctx deadline and a done ctx
+// interrupts its reads and writes.
+// release unbinds ctx once the handshake is over, it returns the ctx
+// error if ctx was done.
+func WithContext(ctx context.Context, conn net.Conn) (c net.Conn, release func() error) {
+	cc := &ctxConn{Conn: conn, ctx: ctx}
+	cc.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		if cc.ctx != nil {
+			cc.Conn.SetDeadline(aLongTimeAgo)
+		}
+	})
+
+	return cc, func() error {
+		stop()
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		cc.ctx = nil
+		cc.Conn.SetDeadline(time.Time{})
+		return ctx.Err()
+	}
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+type ctxConn struct {
+	net.Conn
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+// deadline caps t by the ctx deadline while bound
+func (c *ctxConn) deadline(t time.Time) time.Time {
+	if c.ctx == nil {
+		return t
+	}
+	if c.ctx.Err() != nil {
+		return aLongTimeAgo
+	}
+	if d, ok := c.ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		return d
+	}
+	return t
+}
+
+func (c *ctxConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetDeadline(c.deadline(t))
+}
+
+func (c *ctxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetReadDeadline(c.deadline(t))
+}
+
+func (c *ctxConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(c.deadline(t))
+}
+
+// OpenStreamContext runs open until it returns or ctx is done,
+// a stream opened after ctx is done is closed
+func OpenStreamContext(ctx context.Context, open func() (Stream, error)) (Stream, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	// ctx is never done, skip the goroutine
+	if ctx.Done() == nil {
+		return open()
+	}
+
+	type result struct {
+		stream Stream
+		err    error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		stream, err := open()
+		opened <- result{stream, err}
+	}()
+
+	select {
+	case r := <-opened:
+		return r.stream, r.err
+	case <-ctx.Done():
+		go func() {
+			r := <-opened
+			if r.err == nil {
+				r.stream.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// StreamAcceptor runs the blocking accept of a stream multiplexer in
+// one background goroutine, so that AcceptStreamContext can give up
+// on a done ctx or the deadline without leaving a goroutine behind.
+// The goroutine starts with the first accept and ends with Close
+// or once accept fails.
+type StreamAcceptor struct {
+	accept     func() (Stream, error)
+	timeoutErr error
+	once       sync.Once
+	streams    chan Stream
+	failed     chan struct{}
+	err        error
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+// NewStreamAcceptor creates an acceptor of the streams returned by accept,
+// timeoutErr is returned once the deadline passes
+func NewStreamAcceptor(accept func() (Stream, error), timeoutErr error) *StreamAcceptor {
+	return &StreamAcceptor{
+		accept:     accept,
+		timeoutErr: timeoutErr,
+		streams:    make(chan Stream),
+		failed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (a *StreamAcceptor) serve() {
+	for {
+		stream, err := a.accept()
+		if err != nil {
+			a.err = err
+			close(a.failed)
+			return
+		}
+
+		select {
+		case a.streams <- stream:
+		case <-a.done:
+			stream.Close()
+			return
+		}
+	}
+}
+
+// AcceptStreamContext returns the next stream, it gives up once ctx
+// is done or the deadline passes
+func (a *StreamAcceptor) AcceptStreamContext(ctx context.Context) (Stream, error) {
+	a.once.Do(func() { go a.serve() })
+
+	a.mu.Lock()
+	deadline := a.deadline
+	a.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case stream := <-a.streams:
+		return stream, nil
+	case <-a.failed:
+		return nil, a.err
+	case <-a.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, a.timeoutErr
+	}
+}
+
+// SetDeadline sets the deadline of AcceptStreamContext
+func (a *StreamAcceptor) SetDeadline(t time.Time) {
+	a.mu.Lock()
+	a.deadline = t
+	a.mu.Unlock()
+}
+
+// Close stops accepting, the multiplexer is closed by the caller
+func (a *StreamAcceptor) Close() {
+	a.closeOnce.Do(func() { close(a.done) })
+}
@@ -0,0 +1,126 @@
+package optw
+
+import (
+	"context"
+	"errors"
+	"github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestContext(t *testing.T) {
+	convey.Convey("test context helpers", t, func() {
+		convey.Convey("test cancel interrupts the handshake", func() {
+			client, server := net.Pipe()
+			defer server.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			conn, release := WithContext(ctx, client)
+			defer conn.Close()
+
+			time.AfterFunc(time.Millisecond*50, cancel)
+			conn.SetDeadline(time.Now().Add(time.Second * 5))
+			begin := time.Now()
+			_, err := conn.Read(make([]byte, 1))
+			convey.So(IsTimeout(err), convey.ShouldBeTrue)
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second)
+			convey.So(ContextError(ctx, err), convey.ShouldWrap, context.Canceled)
+			convey.So(errors.Is(release(), context.Canceled), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test ctx deadline caps the handshake deadline", func() {
+			client, server := net.Pipe()
+			defer server.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			conn, _ := WithContext(ctx, client)
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(time.Second * 5))
+			begin := time.Now()
+			_, err := conn.Read(make([]byte, 1))
+			convey.So(IsTimeout(err), convey.ShouldBeTrue)
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second)
+		})
+
+		convey.Convey("test release", func() {
+			client, server := net.Pipe()
+			defer server.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			conn, release := WithContext(ctx, client)
+			defer conn.Close()
+			convey.So(release(), convey.ShouldBeNil)
+
+			// ctx no longer applies once released
+			cancel()
+			go server.Write([]byte("p"))
+			_, err := conn.Read(make([]byte, 1))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(ContextError(context.Background(), err), convey.ShouldBeNil)
+		})
+
+		convey.Convey("test open stream context", func() {
+			opened := make(chan Stream)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := OpenStreamContext(ctx, func() (Stream, error) { return <-opened, nil })
+			convey.So(err, convey.ShouldEqual, context.Canceled)
+
+			ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			_, err = OpenStreamContext(ctx, func() (Stream, error) { return <-opened, nil })
+			convey.So(err, convey.ShouldEqual, context.DeadlineExceeded)
+
+			// the stream opened late is closed
+			client, server := net.Pipe()
+			opened <- client
+			_, err = server.Read(make([]byte, 1))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test stream acceptor", func() {
+			streams := make(chan Stream)
+			errTimeout := errors.New("test timeout")
+			a := NewStreamAcceptor(func() (Stream, error) {
+				stream, ok := <-streams
+				if !ok {
+					return nil, net.ErrClosed
+				}
+				return stream, nil
+			}, errTimeout)
+
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() { streams <- client }()
+			stream, err := a.AcceptStreamContext(context.Background())
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(stream, convey.ShouldEqual, client)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			_, err = a.AcceptStreamContext(ctx)
+			convey.So(err, convey.ShouldEqual, context.DeadlineExceeded)
+
+			a.SetDeadline(time.Now().Add(time.Millisecond * 50))
+			_, err = a.AcceptStreamContext(context.Background())
+			convey.So(err, convey.ShouldEqual, errTimeout)
+			a.SetDeadline(time.Time{})
+
+			close(streams)
+			_, err = a.AcceptStreamContext(context.Background())
+			convey.So(errors.Is(err, net.ErrClosed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test stream acceptor close", func() {
+			blocked := make(chan struct{})
+			defer close(blocked)
+			a := NewStreamAcceptor(func() (Stream, error) {
+				<-blocked
+				return nil, net.ErrClosed
+			}, nil)
+			time.AfterFunc(time.Millisecond*50, a.Close)
+			_, err := a.AcceptStreamContext(context.Background())
+			convey.So(errors.Is(err, net.ErrClosed), convey.ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package optw
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// ParamToken is the reserved endpoint param for the access token
+const ParamToken = "token"
+
+// Endpoint describes a listener or dialer in a single URI, eg:
+//
+//	kcp://1.2.3.4:5000?dataShards=10&mtu=1200&token=xxx
+//	quic://host:443?alpn=foo
+//
+// Params are the transport config keys, named after the config json tags.
+type Endpoint struct {
+	Scheme string
+	Addr   string
+	Params url.Values
+}
+
+// ParseEndpoint parses a URI form endpoint
+func ParseEndpoint(rawurl string) (*Endpoint, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint fail: %v", err)
+	}
+
+	if len(u.Scheme) <= 0 {
+		return nil, fmt.Errorf("parse endpoint %s fail: missing scheme", rawurl)
+	}
+
+	if u.User != nil || len(u.Fragment) > 0 || len(u.Opaque) > 0 {
+		return nil, fmt.Errorf("parse endpoint %s fail: only scheme://addr?params is supported", rawurl)
+	}
+
+	addr := u.Host + u.Path
+	if len(addr) <= 0 {
+		return nil, fmt.Errorf("parse endpoint %s fail: missing address", rawurl)
+	}
+
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint %s fail: %v", rawurl, err)
+	}
+
+	return &Endpoint{
+		Scheme: u.Scheme,
+		Addr:   addr,
+		Params: params,
+	}, nil
+}
+
+// Config returns the endpoint params as a transport Config,
+// without the reserved keys
+func (e *Endpoint) Config() Config {
+	params := url.Values{}
+	for key, values := range e.Params {
+		if key == ParamToken {
+			continue
+		}
+		params[key] = values
+	}
+	return ParamsConfig(params)
+}
+
+// Token returns the access token of the endpoint
+func (e *Endpoint) Token() string {
+	return e.Params.Get(ParamToken)
+}
+
+// String returns the URI form of the endpoint, params are sorted by key
+func (e *Endpoint) String() string {
+	s := e.Scheme + "://" + e.Addr
+	if len(e.Params) > 0 {
+		s += "?" + e.Params.Encode()
+	}
+	return s
+}
@@ -0,0 +1,72 @@
+package optw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// errors wrapped by every transport, test them with errors.Is
+var (
+	ErrAuthFailed        = errors.New("optw: auth failed")
+	ErrHandshakeTimeout  = errors.New("optw: handshake timeout")
+	ErrConnClosed        = errors.New("optw: connection closed")
+	ErrStreamReset       = errors.New("optw: stream reset")
+	ErrUnsupportedScheme = errors.New("optw: unsupported scheme")
+	// the server certificate does not match the pinned
+	// or the known hosts fingerprint
+	ErrFingerprintMismatch = errors.New("optw: certificate fingerprint mismatch")
+	// a psk encrypted frame fails to decrypt, it is tampered,
+	// replayed, or the peer uses another key or cipher
+	ErrFrameAuth = errors.New("optw: frame authentication failed")
+	// the upstream proxy rejects the proxy credentials
+	ErrProxyAuth = errors.New("optw: proxy authentication failed")
+)
+
+// Wrap wraps err with the sentinel kind, keeping err in the chain
+func Wrap(kind, err error) error {
+	if err == nil || errors.Is(err, kind) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
+
+// HandshakeError classifies a handshake error, the deadline is the one
+// set on the handshake so that timeouts are detected whatever error
+// the underlying transport returns for them.
+func HandshakeError(err error, deadline time.Time) error {
+	if err == nil || errors.Is(err, ErrAuthFailed) ||
+		errors.Is(err, ErrHandshakeTimeout) || errors.Is(err, ErrConnClosed) {
+		return err
+	}
+
+	if IsTimeout(err) || (!deadline.IsZero() && !time.Now().Before(deadline)) {
+		return Wrap(ErrHandshakeTimeout, err)
+	}
+
+	if IsClosed(err) {
+		return Wrap(ErrConnClosed, err)
+	}
+	return err
+}
+
+// IsTimeout reports whether err is a deadline error
+func IsTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &ne) && ne.Timeout())
+}
+
+// IsClosed reports whether err means the peer or the local side
+// closed the connection
+func IsClosed(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed)
+}
@@ -24,13 +24,23 @@ func main() {
 	switch protocol {
 	case "quic":
 		listener = quic.NewListener(addr)
-		dialer = quic.NewDialer(addr)
+		// the listener runs an ephemeral self-signed certificate
+		cfg := quic.DefaultConfig()
+		cfg.InsecureSkipVerify = true
+		dialer = quic.NewDialerWithConfig(addr, cfg)
 	case "mux":
 		listener = mux.NewListener(addr)
 		dialer = mux.NewDialer(addr)
 	case "kcp":
-		listener = kcp.NewListener(addr, nil)
-		dialer = kcp.NewDialer(addr, nil)
+		var err error
+		listener, err = kcp.NewListener(addr, nil)
+		if err != nil {
+			panic(err)
+		}
+		dialer, err = kcp.NewDialer(addr, nil)
+		if err != nil {
+			panic(err)
+		}
 	default:
 		panic("unsupported protocol")
 	}
@@ -46,7 +56,7 @@ func main() {
 
 		stream, err := conn.OpenStream()
 		if err != nil {
-			fmt.Println("dialer open stream fail: %v", err)
+			fmt.Println("dialer open stream fail: ", err)
 			return
 		}
 		defer stream.Close()
@@ -0,0 +1,126 @@
+// Package smuxconn is the optw.Conn of the transports running smux
+// over their connections.
+package smuxconn
+
+import (
+	"context"
+	"github.com/ICKelin/optw"
+	"net"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+var _ optw.Conn = &Conn{}
+
+// Conn is an optw.Conn running the streams of a smux session
+type Conn struct {
+	mux      *smux.Session
+	streams  *optw.StreamAcceptor
+	identity interface{}
+	metadata map[string]string
+}
+
+// New wraps the smux session mux in a Conn
+func New(mux *smux.Session, identity interface{}, metadata map[string]string) *Conn {
+	accept := func() (optw.Stream, error) {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	return &Conn{
+		mux:      mux,
+		streams:  optw.NewStreamAcceptor(accept, smux.ErrTimeout),
+		identity: identity,
+		metadata: metadata,
+	}
+}
+
+func (c *Conn) OpenStream() (optw.Stream, error) {
+	return c.OpenStreamContext(context.Background())
+}
+
+func (c *Conn) OpenStreamContext(ctx context.Context) (optw.Stream, error) {
+	stream, err := optw.OpenStreamContext(ctx, func() (optw.Stream, error) {
+		stream, err := c.mux.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	})
+	if err != nil {
+		return nil, c.streamError(err)
+	}
+
+	return stream, nil
+}
+
+func (c *Conn) AcceptStream() (optw.Stream, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+func (c *Conn) AcceptStreamContext(ctx context.Context) (optw.Stream, error) {
+	stream, err := c.streams.AcceptStreamContext(ctx)
+	if err != nil {
+		return nil, c.streamError(err)
+	}
+
+	return stream, nil
+}
+
+// streamError wraps errors of a dead session with optw.ErrConnClosed
+func (c *Conn) streamError(err error) error {
+	if c.mux.IsClosed() || optw.IsClosed(err) {
+		return optw.Wrap(optw.ErrConnClosed, err)
+	}
+	return err
+}
+
+func (c *Conn) Close() {
+	c.streams.Close()
+	c.mux.Close()
+}
+
+func (c *Conn) IsClosed() bool {
+	return c.mux.IsClosed()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.mux.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.mux.LocalAddr()
+}
+
+// SetDeadline sets the deadline of AcceptStream
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.streams.SetDeadline(t)
+	return nil
+}
+
+func (c *Conn) Identity() interface{} {
+	return c.identity
+}
+
+func (c *Conn) Metadata() map[string]string {
+	return c.metadata
+}
+
+// Config returns the smux config with the keepalive interval and timeout
+// of the transport config, the keepalive options take precedence.
+// a zero interval or timeout keeps the smux default.
+func Config(interval, timeout time.Duration, opts optw.Options) *smux.Config {
+	cfg := smux.DefaultConfig()
+	if interval > 0 {
+		cfg.KeepAliveInterval = interval
+	}
+	if timeout > 0 {
+		cfg.KeepAliveTimeout = timeout
+	}
+	cfg.KeepAliveInterval, cfg.KeepAliveTimeout = opts.KeepAlive(cfg.KeepAliveInterval, cfg.KeepAliveTimeout)
+	return cfg
+}
@@ -1,5 +1,13 @@
 package kcp
 
+import (
+	"fmt"
+	"github.com/ICKelin/optw"
+)
+
+// maxBuffer is the upper bound of socket buffers
+const maxBuffer = 1 << 28
+
 type KCPConfig struct {
 	// fec args
 	FecDataShards   int `json:"dataShards"`
@@ -16,4 +24,88 @@ type KCPConfig struct {
 	AckNoDelay bool `json:"ackNoDelay"`
 	Rcvbuf     int  `json:"rcvBuf"`
 	SndBuf     int  `json:"sndBuf"`
+	// packet encryption, aes, aes-128, aes-192, salsa20, blowfish,
+	// twofish, cast5, 3des, tea, xtea, sm4, xor or none.
+	// the key is a passphrase, empty crypt with a key means aes.
+	Crypt string `json:"crypt"`
+	Key   string `json:"key"`
+	// settings hello before the session, a fec mismatch fails the dial
+	// with ErrSettingsMismatch. listeners do not answer the hello of
+	// another crypt or key, the dial times out. enable it on the
+	// listener first, listeners before it do not answer the hello.
+	Hello bool `json:"hello"`
+	optw.HandshakeConfig
+	optw.NoiseConfig
+}
+
+var defaultConfig = KCPConfig{
+	FecDataShards:   10,
+	FecParityShards: 3,
+	Nodelay:         1,
+	Interval:        10,
+	Resend:          2,
+	Nc:              1,
+	SndWnd:          1024,
+	RcvWnd:          1024,
+	Mtu:             1350,
+	AckNoDelay:      true,
+	Rcvbuf:          4194304,
+	SndBuf:          4194304,
+	HandshakeConfig: optw.DefaultHandshakeConfig,
+}
+
+// DefaultConfig returns the config used for unset fields
+func DefaultConfig() KCPConfig {
+	return defaultConfig
+}
+
+// parseConfig lays rawConfig over the default config and validates it
+func parseConfig(rawConfig []byte) (KCPConfig, error) {
+	cfg := defaultConfig
+	err := optw.JSONConfig(rawConfig).Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("kcp: %v", err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate range-checks the config
+func (c KCPConfig) Validate() error {
+	if c.FecDataShards < 0 || c.FecParityShards < 0 {
+		return fmt.Errorf("kcp: invalid fec shards %d/%d, expect non negative", c.FecDataShards, c.FecParityShards)
+	}
+	if (c.FecDataShards == 0) != (c.FecParityShards == 0) {
+		return fmt.Errorf("kcp: invalid fec shards %d/%d, set both to 0 to disable fec", c.FecDataShards, c.FecParityShards)
+	}
+	if c.FecDataShards+c.FecParityShards > 256 {
+		return fmt.Errorf("kcp: invalid fec shards %d/%d, expect at most 256 shards", c.FecDataShards, c.FecParityShards)
+	}
+	if c.Nodelay != 0 && c.Nodelay != 1 {
+		return fmt.Errorf("kcp: invalid nodelay %d, expect 0 or 1", c.Nodelay)
+	}
+	if c.Interval < 10 || c.Interval > 5000 {
+		return fmt.Errorf("kcp: invalid interval %d, expect [10, 5000]", c.Interval)
+	}
+	if c.Resend < 0 {
+		return fmt.Errorf("kcp: invalid resend %d, expect non negative", c.Resend)
+	}
+	if c.Nc != 0 && c.Nc != 1 {
+		return fmt.Errorf("kcp: invalid nc %d, expect 0 or 1", c.Nc)
+	}
+	if c.SndWnd < 1 || c.SndWnd > 65535 {
+		return fmt.Errorf("kcp: invalid sndwnd %d, expect [1, 65535]", c.SndWnd)
+	}
+	if c.RcvWnd < 1 || c.RcvWnd > 65535 {
+		return fmt.Errorf("kcp: invalid rcvwnd %d, expect [1, 65535]", c.RcvWnd)
+	}
+	if c.Mtu < 50 || c.Mtu > 1500 {
+		return fmt.Errorf("kcp: invalid mtu %d, expect [50, 1500]", c.Mtu)
+	}
+	if c.Rcvbuf < 1 || c.Rcvbuf > maxBuffer {
+		return fmt.Errorf("kcp: invalid rcvBuf %d, expect [1, %d]", c.Rcvbuf, maxBuffer)
+	}
+	if c.SndBuf < 1 || c.SndBuf > maxBuffer {
+		return fmt.Errorf("kcp: invalid sndBuf %d, expect [1, %d]", c.SndBuf, maxBuffer)
+	}
+	return c.validateCrypt()
 }
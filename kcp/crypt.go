@@ -0,0 +1,95 @@
+package kcp
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	kcpgo "github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	cryptNone = "none"
+
+	kdfSalt       = "optw/kcp"
+	kdfIterations = 4096
+	kdfKeySize    = 32
+)
+
+// cryptFactories maps the cipher names to kcp-go block crypts
+// and the key size they consume
+var cryptFactories = map[string]struct {
+	keySize int
+	new     func(key []byte) (kcpgo.BlockCrypt, error)
+}{
+	"aes":      {32, kcpgo.NewAESBlockCrypt},
+	"aes-128":  {16, kcpgo.NewAESBlockCrypt},
+	"aes-192":  {24, kcpgo.NewAESBlockCrypt},
+	"salsa20":  {32, kcpgo.NewSalsa20BlockCrypt},
+	"blowfish": {32, kcpgo.NewBlowfishBlockCrypt},
+	"twofish":  {32, kcpgo.NewTwofishBlockCrypt},
+	"cast5":    {16, kcpgo.NewCast5BlockCrypt},
+	"3des":     {24, kcpgo.NewTripleDESBlockCrypt},
+	"tea":      {16, kcpgo.NewTEABlockCrypt},
+	"xtea":     {16, kcpgo.NewXTEABlockCrypt},
+	"sm4":      {16, kcpgo.NewSM4BlockCrypt},
+	"xor":      {32, kcpgo.NewSimpleXORBlockCrypt},
+	cryptNone:  {32, kcpgo.NewNoneBlockCrypt},
+}
+
+// cipher returns the effective cipher name, a key without cipher means aes
+func (c KCPConfig) cipher() string {
+	if len(c.Crypt) <= 0 && len(c.Key) > 0 {
+		return "aes"
+	}
+	return c.Crypt
+}
+
+func (c KCPConfig) validateCrypt() error {
+	cipher := c.cipher()
+	if len(cipher) <= 0 {
+		return nil
+	}
+
+	if _, ok := cryptFactories[cipher]; !ok {
+		return fmt.Errorf("kcp: unsupported crypt %s", cipher)
+	}
+	if cipher != cryptNone && len(c.Key) <= 0 {
+		return fmt.Errorf("kcp: crypt %s requires a key", cipher)
+	}
+	return nil
+}
+
+// cryptKey derives the key from the passphrase with pbkdf2,
+// nil without crypt or with crypt none
+func (c KCPConfig) cryptKey() []byte {
+	cipher := c.cipher()
+	if len(cipher) <= 0 || cipher == cryptNone {
+		return nil
+	}
+	return pbkdf2.Key([]byte(c.Key), []byte(kdfSalt), kdfIterations, kdfKeySize, sha256.New)
+}
+
+// blockCrypt returns the block crypt for the config,
+// nil means the packets are sent as is.
+func (c KCPConfig) blockCrypt() (kcpgo.BlockCrypt, error) {
+	cipher := c.cipher()
+	if len(cipher) <= 0 {
+		return nil, nil
+	}
+
+	factory, ok := cryptFactories[cipher]
+	if !ok {
+		return nil, fmt.Errorf("kcp: unsupported crypt %s", cipher)
+	}
+
+	key := c.cryptKey()
+	if key == nil {
+		key = make([]byte, kdfKeySize)
+	}
+	block, err := factory.new(key[:factory.keySize])
+	if err != nil {
+		return nil, fmt.Errorf("kcp: create crypt %s fail: %v", cipher, err)
+	}
+	return block, nil
+}
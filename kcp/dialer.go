@@ -1,68 +1,90 @@
 package kcp
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/internal/smuxconn"
 	kcpgo "github.com/xtaci/kcp-go"
 	"github.com/xtaci/smux"
+	"net"
 	"time"
 )
 
 var _ optw.Dialer = &Dialer{}
 
-var defaultConfig = KCPConfig{
-	FecDataShards:   10,
-	FecParityShards: 3,
-	Nodelay:         1,
-	Interval:        10,
-	Resend:          2,
-	Nc:              1,
-	SndWnd:          1024,
-	RcvWnd:          1024,
-	Mtu:             1350,
-	AckNoDelay:      true,
-	Rcvbuf:          4194304,
-	SndBuf:          4194304,
-}
-
 type Dialer struct {
 	remote      string
 	config      KCPConfig
 	accessToken string
+	metadata    map[string]string
+	options     optw.Options
 }
 
 func (dialer *Dialer) SetAccessToken(accessToken string) {
 	dialer.accessToken = accessToken
 }
 
-func NewDialer(remote string, rawConfig json.RawMessage) *Dialer {
-	dialer := &Dialer{remote: remote}
-	if len(rawConfig) <= 0 {
-		dialer.config = defaultConfig
-	} else {
-		cfg := KCPConfig{}
-		json.Unmarshal(rawConfig, &cfg)
-		dialer.config = cfg
+func (dialer *Dialer) SetMetadata(md map[string]string) {
+	dialer.metadata = md
+}
+
+// SetOptions sets the options shared by the transports
+func (dialer *Dialer) SetOptions(opts ...optw.Option) {
+	dialer.options.Apply(opts...)
+	dialer.config.HandshakeConfig = dialer.options.Handshake(dialer.config.HandshakeConfig)
+}
+
+// NewDialer creates a dialer, rawConfig is laid over the default config
+func NewDialer(remote string, rawConfig json.RawMessage) (*Dialer, error) {
+	cfg, err := parseConfig(rawConfig)
+	if err != nil {
+		return nil, err
 	}
-	return dialer
+	return &Dialer{remote: remote, config: cfg}, nil
+}
+
+func NewDialerWithConfig(remote string, cfg KCPConfig) (*Dialer, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{remote: remote, config: cfg}, nil
 }
 
 func (dialer *Dialer) Dial() (optw.Conn, error) {
+	return dialer.DialContext(context.Background())
+}
+
+func (dialer *Dialer) DialContext(ctx context.Context) (optw.Conn, error) {
 	cfg := dialer.config
-	conn, err := kcpgo.DialWithOptions(dialer.remote, nil, cfg.FecDataShards, cfg.FecParityShards)
+	block, err := cfg.blockCrypt()
 	if err != nil {
 		return nil, err
 	}
 
-	// enable auth
-	if len(dialer.accessToken) > 0 {
-		conn.SetDeadline(time.Now().Add(time.Second * 5))
-		err = optw.AuthRequest(conn, dialer.accessToken)
-		conn.SetDeadline(time.Time{})
-		if err != nil {
-			conn.Close()
-			return nil, err
-		}
+	// kcp has no connect, the dial timeout bounds the hello
+	// and the handshake which establish the session
+	if dialer.options.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.options.DialTimeout)
+		defer cancel()
+	}
+
+	conn, err := dialer.dial(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, release := optw.WithContext(ctx, conn)
+	stream, err = dialer.handshake(ctx, stream)
+	if err != nil {
+		return nil, optw.ContextError(ctx, err)
+	}
+	err = release()
+	if err != nil {
+		stream.Close()
+		return nil, err
 	}
 
 	conn.SetStreamMode(true)
@@ -74,9 +96,81 @@ func (dialer *Dialer) Dial() (optw.Conn, error) {
 	conn.SetReadBuffer(cfg.Rcvbuf)
 	conn.SetWriteBuffer(cfg.SndBuf)
 
-	sess, err := smux.Client(conn, nil)
+	sess, err := smux.Client(stream, smuxconn.Config(0, 0, dialer.options))
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return &Conn{sess}, err
+	return smuxconn.New(sess, nil, dialer.metadata), err
+}
+
+// dial creates the kcp session after the settings hello,
+// bound to the local address option if set
+func (dialer *Dialer) dial(ctx context.Context, block kcpgo.BlockCrypt) (*kcpgo.UDPSession, error) {
+	cfg := dialer.config
+	if len(dialer.options.LocalAddr) <= 0 && !cfg.Hello {
+		return kcpgo.DialWithOptions(dialer.remote, block, cfg.FecDataShards, cfg.FecParityShards)
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", dialer.remote)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := dialer.options.UDPAddr("udp")
+	if err != nil {
+		return nil, err
+	}
+	network := "udp"
+	if laddr == nil && raddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	udp, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Hello {
+		err = helloRequest(ctx, udp, raddr, cfg, cfg.Timeout())
+		if err != nil {
+			udp.Close()
+			return nil, err
+		}
+	}
+
+	conn, err := kcpgo.NewConn2(raddr, block, cfg.FecDataShards, cfg.FecParityShards, udp)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshake runs the auth handshake over conn,
+// conn is closed on failure
+func (dialer *Dialer) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	cfg := dialer.config
+	switch {
+	case cfg.Noise:
+		return dialer.noiseHandshake(ctx, conn)
+	case len(dialer.accessToken) > 0:
+		deadline := dialer.deadline(ctx)
+		conn.SetDeadline(deadline)
+		err := dialer.options.AuthRequest(conn, dialer.accessToken, dialer.metadata)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, optw.HandshakeError(err, deadline)
+		}
+	}
+	return conn, nil
+}
+
+// deadline returns the handshake deadline capped by the ctx one,
+// kcp timeouts are only detected by the deadline
+func (dialer *Dialer) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(dialer.config.Timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
 }
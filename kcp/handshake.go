@@ -0,0 +1,235 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"net"
+	"time"
+)
+
+// settings hello, a plain udp datagram the dialer sends before the kcp
+// session so that peers with different fec settings, crypt or key fail
+// with a clear error, a mismatch drops the kcp packets of the peer.
+// it is opt-in on both sides, the listener answers it with Hello enabled
+// and passes the other packets to kcp.
+// the dialer resends the request until a reply or the dial timeout.
+// the listener only answers full requests proving the crypt and key, at
+// most once per interval and source ip, and the reply is smaller than the
+// request so that the hello can not be used to reflect traffic.
+//
+//	request: | magic 8 | version 1 | dataShards 2 | parityShards 2 | nonce 16 |
+//	         | hmac(crypt key, label, crypt, nonce) 32 |
+//	reply:   | magic 8 | version 1 | status 1 | dataShards 2 | parityShards 2 |
+var (
+	helloMagic = []byte("optw-kcp")
+	helloLabel = []byte("optw kcp hello")
+)
+
+const (
+	helloVersion     = 1
+	helloNonceSize   = 16
+	helloRequestSize = 13 + helloNonceSize + sha256.Size
+	helloReplySize   = 14
+	helloInterval    = time.Millisecond * 500
+	// min interval between the replies to a source ip
+	helloReplyInterval = time.Millisecond * 100
+
+	helloOK              = 0
+	helloFecMismatch     = 1
+	helloVersionMismatch = 2
+)
+
+// ErrSettingsMismatch is wrapped by the dial error when the server runs
+// other fec settings
+var ErrSettingsMismatch = errors.New("kcp: settings mismatch")
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func isHello(buf []byte) bool {
+	return len(buf) > len(helloMagic) && bytes.Equal(buf[:len(helloMagic)], helloMagic)
+}
+
+// cryptProof proves the crypt and key to the peer without the key,
+// key is the derived crypt key
+func (c KCPConfig) cryptProof(key, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(helloLabel)
+	mac.Write([]byte(c.cipher()))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func (c KCPConfig) helloRequest(key []byte) ([]byte, error) {
+	nonce := make([]byte, helloNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, helloRequestSize)
+	buf = append(buf, helloMagic...)
+	buf = append(buf, helloVersion)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(c.FecDataShards))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(c.FecParityShards))
+	buf = append(buf, nonce...)
+	return append(buf, c.cryptProof(key, nonce)...), nil
+}
+
+// helloReply returns the reply to the request req, nil unless req is
+// a full request proving the crypt and key, key is the derived crypt key
+func (c KCPConfig) helloReply(req, key []byte) []byte {
+	if len(req) != helloRequestSize ||
+		!hmac.Equal(req[13+helloNonceSize:], c.cryptProof(key, req[13:13+helloNonceSize])) {
+		return nil
+	}
+
+	status := byte(helloOK)
+	switch {
+	case req[len(helloMagic)] != helloVersion:
+		status = helloVersionMismatch
+	case int(binary.BigEndian.Uint16(req[9:])) != c.FecDataShards ||
+		int(binary.BigEndian.Uint16(req[11:])) != c.FecParityShards:
+		status = helloFecMismatch
+	}
+
+	buf := make([]byte, 0, helloReplySize)
+	buf = append(buf, helloMagic...)
+	buf = append(buf, helloVersion, status)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(c.FecDataShards))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(c.FecParityShards))
+	return buf
+}
+
+// checkHelloReply returns the error of the server reply
+func (c KCPConfig) checkHelloReply(reply []byte) error {
+	dataShards := int(binary.BigEndian.Uint16(reply[10:]))
+	parityShards := int(binary.BigEndian.Uint16(reply[12:]))
+	switch reply[9] {
+	case helloOK:
+		return nil
+	case helloFecMismatch:
+		return fmt.Errorf("%w: fec settings mismatch, local %d/%d, remote %d/%d",
+			ErrSettingsMismatch, c.FecDataShards, c.FecParityShards, dataShards, parityShards)
+	case helloVersionMismatch:
+		return fmt.Errorf("%w: unsupported settings hello version %d", ErrSettingsMismatch, helloVersion)
+	default:
+		return fmt.Errorf("kcp: invalid settings hello status %d", reply[9])
+	}
+}
+
+// helloRequest sends the settings hello on udp to raddr until the server
+// replies, udp is not used by kcp yet.
+// A mismatched crypt or key gets no reply, it fails with the timeout.
+func helloRequest(ctx context.Context, udp net.PacketConn, raddr net.Addr, cfg KCPConfig, timeout time.Duration) error {
+	stop := context.AfterFunc(ctx, func() {
+		udp.SetReadDeadline(aLongTimeAgo)
+	})
+	defer stop()
+	defer udp.SetReadDeadline(time.Time{})
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	req, err := cfg.helloRequest(cfg.cryptKey())
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, helloReplySize+1)
+	for {
+		_, err = udp.WriteTo(req, raddr)
+		if err != nil {
+			return fmt.Errorf("kcp: write settings hello fail: %w", err)
+		}
+
+		next := time.Now().Add(helloInterval)
+		if next.After(deadline) {
+			next = deadline
+		}
+		udp.SetReadDeadline(next)
+		// a cancel before the deadline is set is not seen by the AfterFunc
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				if errors.Is(ctx.Err(), context.Canceled) {
+					return optw.ContextError(ctx, err)
+				}
+				if optw.IsTimeout(err) && time.Now().Before(deadline) {
+					break
+				}
+				err = fmt.Errorf("kcp: read settings hello fail: %w, check that the server "+
+					"enables hello with the same crypt and key, local crypt %q", err, cfg.cipher())
+				return optw.HandshakeError(optw.ContextError(ctx, err), deadline)
+			}
+
+			if from.String() == raddr.String() && n == helloReplySize && isHello(buf[:n]) {
+				return cfg.checkHelloReply(buf[:n])
+			}
+		}
+	}
+}
+
+// helloConn is the packet conn of a listener with hello enabled,
+// it answers the settings hellos and passes the other packets to kcp.
+// ReadFrom is only called by the read loop of kcp.
+type helloConn struct {
+	net.PacketConn
+	config KCPConfig
+	// derived once instead of for each hello
+	key []byte
+	// source ips replied in the current and the previous interval,
+	// the maps are rotated instead of swept
+	replied map[string]bool
+	prev    map[string]bool
+	rotated time.Time
+}
+
+func (c *helloConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !isHello(b[:n]) {
+			return n, addr, err
+		}
+
+		reply := c.config.helloReply(b[:n], c.key)
+		if reply != nil && c.allow(addr) {
+			c.PacketConn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// allow reports whether the source ip of addr may get a reply,
+// once per reply interval
+func (c *helloConn) allow(addr net.Addr) bool {
+	now := time.Now()
+	if elapsed := now.Sub(c.rotated); elapsed >= helloReplyInterval {
+		c.prev = c.replied
+		if elapsed >= helloReplyInterval*2 {
+			c.prev = nil
+		}
+		c.replied = make(map[string]bool)
+		c.rotated = now
+	}
+
+	ip := addr.String()
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		ip = udp.IP.String()
+	}
+	if c.replied[ip] || c.prev[ip] {
+		return false
+	}
+	c.replied[ip] = true
+	return true
+}
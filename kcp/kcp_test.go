@@ -1,9 +1,13 @@
 package kcp
 
 import (
+	"context"
+	"errors"
+	"github.com/ICKelin/optw"
 	"github.com/smartystreets/goconvey/convey"
 	"github.com/xtaci/smux"
-	"strings"
+	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -12,7 +16,8 @@ import (
 func TestKCP(t *testing.T) {
 	convey.Convey("test optw transport/mux", t, func() {
 		convey.Convey("test auth success", func() {
-			l := NewListener("127.0.0.1:2001", nil)
+			l, err := NewListener("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
 			l.SetAuthFunc(func(token string) bool {
 				if token == "test auth" {
 					return true
@@ -21,8 +26,11 @@ func TestKCP(t *testing.T) {
 			})
 			l.Listen()
 			defer l.Close()
-			d := NewDialer("127.0.0.1:2001", nil)
+			d, err := NewDialer("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
 			d.SetAccessToken("test auth")
+			// the auth func checks the plaintext token
+			d.SetOptions(optw.WithLegacyAuth(true))
 
 			go func() {
 				_, err := l.Accept()
@@ -38,7 +46,8 @@ func TestKCP(t *testing.T) {
 		})
 
 		convey.Convey("test auth fail", func() {
-			l := NewListener("127.0.0.1:2001", nil)
+			l, err := NewListener("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
 			l.SetAuthFunc(func(token string) bool {
 				if token == "test auth" {
 					return true
@@ -47,30 +56,31 @@ func TestKCP(t *testing.T) {
 			})
 			l.Listen()
 			defer l.Close()
-			d := NewDialer("127.0.0.1:2001", nil)
+			d, err := NewDialer("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
 			d.SetAccessToken("invalid test auth")
+			// the auth func checks the plaintext token
+			d.SetOptions(optw.WithLegacyAuth(true))
 
 			go func() {
 				_, err := l.Accept()
-				if err == nil {
-					t.Error("err should not be nil")
-				}
-				exist := strings.Contains(err.Error(), "auth fail")
-				if !exist {
-					t.Error("err should contains auth keyword")
+				if !errors.Is(err, optw.ErrAuthFailed) {
+					t.Error("err should be ErrAuthFailed, got ", err)
 				}
 			}()
 
 			time.Sleep(time.Second * 1)
-			_, err := d.Dial()
-			convey.So(err, convey.ShouldNotBeNil)
+			_, err = d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
 		})
 
 		convey.Convey("no auth test", func() {
-			l := NewListener("127.0.0.1:2001", nil)
+			l, err := NewListener("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
 			l.Listen()
 			defer l.Close()
-			d := NewDialer("127.0.0.1:2001", nil)
+			d, err := NewDialer("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
 
 			wg := sync.WaitGroup{}
 			wg.Add(1)
@@ -92,10 +102,12 @@ func TestKCP(t *testing.T) {
 		})
 
 		convey.Convey("test reconnect", func() {
-			l := NewListener("127.0.0.1:2001", nil)
+			l, err := NewListener("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
 			l.Listen()
 			defer l.Close()
-			d := NewDialer("127.0.0.1:2001", nil)
+			d, err := NewDialer("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
 
 			wg := sync.WaitGroup{}
 			wg.Add(1)
@@ -124,3 +136,345 @@ func TestKCP(t *testing.T) {
 		})
 	})
 }
+
+func TestKCPConfig(t *testing.T) {
+	convey.Convey("test kcp config", t, func() {
+		convey.Convey("test partial config", func() {
+			d, err := NewDialer("127.0.0.1:2001", []byte(`{"mtu": 1200}`))
+			convey.So(err, convey.ShouldBeNil)
+			expect := DefaultConfig()
+			expect.Mtu = 1200
+			convey.So(d.config, convey.ShouldResemble, expect)
+		})
+
+		convey.Convey("test unknown field", func() {
+			_, err := NewDialer("127.0.0.1:2001", []byte(`{"mut": 1200}`))
+			convey.So(err, convey.ShouldNotBeNil)
+			_, err = NewListener("127.0.0.1:2001", []byte(`{"mtu": "1200"}`))
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test validate", func() {
+			invalids := []string{
+				`{"mtu": 0}`,
+				`{"mtu": 9000}`,
+				`{"sndwnd": 0}`,
+				`{"rcvwnd": 70000}`,
+				`{"dataShards": 10, "parityShards": 0}`,
+				`{"dataShards": 250, "parityShards": 10}`,
+				`{"nodelay": 2}`,
+				`{"interval": 0}`,
+				`{"rcvBuf": 0}`,
+				`{"sndBuf": -1}`,
+			}
+			for _, raw := range invalids {
+				_, err := NewListener("127.0.0.1:2001", []byte(raw))
+				convey.So(err, convey.ShouldNotBeNil)
+			}
+
+			_, err := NewListener("127.0.0.1:2001", []byte(`{"dataShards": 0, "parityShards": 0}`))
+			convey.So(err, convey.ShouldBeNil)
+		})
+	})
+}
+
+func TestKCPFec(t *testing.T) {
+	convey.Convey("test kcp fec settings", t, func() {
+		convey.Convey("test fec disabled", func() {
+			cfg := []byte(`{"dataShards": 0, "parityShards": 0, "rcvBuf": 1048576, "sndBuf": 1048576}`)
+			l, err := NewListener("127.0.0.1:2001", cfg)
+			convey.So(err, convey.ShouldBeNil)
+			err = l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			sndbuf := "test buffer"
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					t.Error("err should be nil, got ", err)
+					return
+				}
+				defer conn.Close()
+
+				stream, err := conn.AcceptStream()
+				if err != nil {
+					t.Error("err should be nil, got ", err)
+					return
+				}
+				io.Copy(stream, stream)
+			}()
+
+			d, err := NewDialer("127.0.0.1:2001", cfg)
+			convey.So(err, convey.ShouldBeNil)
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			_, err = stream.Write([]byte(sndbuf))
+			convey.So(err, convey.ShouldBeNil)
+			buf := make([]byte, len(sndbuf))
+			_, err = io.ReadFull(stream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, sndbuf)
+		})
+
+		convey.Convey("test fec shards mismatch", func() {
+			l, err := NewListener("127.0.0.1:2001", []byte(`{"hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			l.Listen()
+			defer l.Close()
+
+			d, err := NewDialer("127.0.0.1:2001", []byte(`{"dataShards": 5, "parityShards": 2, "hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			_, err = d.Dial()
+			convey.So(errors.Is(err, ErrSettingsMismatch), convey.ShouldBeTrue)
+			convey.So(err.Error(), convey.ShouldContainSubstring, "fec settings mismatch, local 5/2, remote 10/3")
+		})
+
+		convey.Convey("test fec disabled on one side", func() {
+			l, err := NewListener("127.0.0.1:2001", []byte(`{"hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			l.Listen()
+			defer l.Close()
+
+			d, err := NewDialer("127.0.0.1:2001", []byte(`{"dataShards": 0, "parityShards": 0, "hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			begin := time.Now()
+			_, err = d.Dial()
+			convey.So(errors.Is(err, ErrSettingsMismatch), convey.ShouldBeTrue)
+			convey.So(err.Error(), convey.ShouldContainSubstring, "local 0/0, remote 10/3")
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second)
+		})
+
+		convey.Convey("test hello is opt-in", func() {
+			// a dialer without hello talks to a listener with hello
+			l, err := NewListener("127.0.0.1:2001", []byte(`{"hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			l.Listen()
+			go func() {
+				conn, err := l.Accept()
+				if err == nil {
+					conn.Close()
+				}
+			}()
+
+			d, err := NewDialer("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+			l.Close()
+
+			// a listener without hello does not answer it
+			l, err = NewListener("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
+			l.Listen()
+			defer l.Close()
+
+			d, err = NewDialer("127.0.0.1:2001", []byte(`{"hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			d.SetOptions(optw.WithDialTimeout(time.Millisecond * 500))
+			_, err = d.Dial()
+			convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+			convey.So(err.Error(), convey.ShouldContainSubstring, "check that the server enables hello")
+		})
+
+		convey.Convey("test dial timeout without hello", func() {
+			// nothing listens, the handshake is bounded by the dial timeout
+			d, err := NewDialer("127.0.0.1:2001", nil)
+			convey.So(err, convey.ShouldBeNil)
+			d.SetAccessToken("test auth")
+			d.SetOptions(optw.WithDialTimeout(time.Millisecond * 300))
+			begin := time.Now()
+			_, err = d.Dial()
+			convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(time.Millisecond*100, cancel)
+			begin = time.Now()
+			_, err = d.DialContext(ctx)
+			convey.So(errors.Is(err, context.Canceled), convey.ShouldBeTrue)
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Millisecond*300)
+		})
+	})
+}
+
+func TestKCPCrypt(t *testing.T) {
+	convey.Convey("test kcp crypt", t, func() {
+		convey.Convey("test crypt success", func() {
+			for _, crypt := range []string{"aes", "aes-128", "salsa20", "xtea", "none"} {
+				cfg := []byte(`{"crypt": "` + crypt + `", "key": "test key"}`)
+				l, err := NewListener("127.0.0.1:2001", cfg)
+				convey.So(err, convey.ShouldBeNil)
+				err = l.Listen()
+				convey.So(err, convey.ShouldBeNil)
+				l.SetAccessToken("test auth")
+
+				go func() {
+					conn, err := l.Accept()
+					if err != nil {
+						t.Error("err should be nil, got ", err)
+						return
+					}
+					conn.Close()
+				}()
+
+				d, err := NewDialer("127.0.0.1:2001", cfg)
+				convey.So(err, convey.ShouldBeNil)
+				d.SetAccessToken("test auth")
+				conn, err := d.Dial()
+				convey.So(err, convey.ShouldBeNil)
+				conn.Close()
+				l.Close()
+			}
+		})
+
+		convey.Convey("test key mismatch", func() {
+			l, err := NewListener("127.0.0.1:2001", []byte(`{"crypt": "aes", "key": "test key", "hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			l.SetAccessToken("test auth")
+			l.Listen()
+			defer l.Close()
+
+			for _, cfg := range []string{
+				`{"crypt": "aes", "key": "invalid test key", "hello": true}`,
+				`{"crypt": "salsa20", "key": "test key", "hello": true}`,
+				`{"hello": true}`,
+			} {
+				d, err := NewDialer("127.0.0.1:2001", []byte(cfg))
+				convey.So(err, convey.ShouldBeNil)
+				d.SetAccessToken("test auth")
+				// the listener does not answer a hello of another crypt or key
+				d.SetOptions(optw.WithDialTimeout(time.Millisecond * 300))
+				_, err = d.Dial()
+				convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+				convey.So(err.Error(), convey.ShouldContainSubstring, "with the same crypt and key")
+			}
+
+			d, err := NewDialer("127.0.0.1:2001", []byte(`{"crypt": "aes", "key": "test key", "hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			d.SetAccessToken("test auth")
+			go func() {
+				conn, err := l.Accept()
+				if err == nil {
+					conn.Close()
+				}
+			}()
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+		})
+
+		convey.Convey("test hello reflection", func() {
+			l, err := NewListener("127.0.0.1:2001", []byte(`{"crypt": "aes", "key": "test key", "hello": true}`))
+			convey.So(err, convey.ShouldBeNil)
+			l.Listen()
+			defer l.Close()
+
+			udp, err := net.ListenUDP("udp4", nil)
+			convey.So(err, convey.ShouldBeNil)
+			defer udp.Close()
+			raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2001")
+			convey.So(err, convey.ShouldBeNil)
+			reply := func(req []byte) []byte {
+				udp.WriteTo(req, raddr)
+				udp.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+				buf := make([]byte, 1500)
+				n, _, err := udp.ReadFrom(buf)
+				if err != nil {
+					return nil
+				}
+				return buf[:n]
+			}
+
+			cfg := defaultConfig
+			cfg.Crypt, cfg.Key = "aes", "invalid test key"
+			invalid, err := cfg.helloRequest(cfg.cryptKey())
+			convey.So(err, convey.ShouldBeNil)
+			cfg.Key = "test key"
+			req, err := cfg.helloRequest(cfg.cryptKey())
+			convey.So(err, convey.ShouldBeNil)
+
+			// short, oversized and unproven requests get no reply
+			convey.So(reply(helloMagic), convey.ShouldBeNil)
+			convey.So(reply(append(helloMagic, 1)), convey.ShouldBeNil)
+			convey.So(reply(append(append([]byte{}, req...), 0)), convey.ShouldBeNil)
+			convey.So(reply(invalid), convey.ShouldBeNil)
+
+			rep := reply(req)
+			convey.So(len(rep), convey.ShouldEqual, helloReplySize)
+			convey.So(len(rep), convey.ShouldBeLessThan, len(req))
+			convey.So(cfg.checkHelloReply(rep), convey.ShouldBeNil)
+
+			// the replies to a source are rate limited
+			convey.So(reply(req), convey.ShouldBeNil)
+			time.Sleep(helloReplyInterval * 2)
+			udp.WriteTo(req, raddr)
+			convey.So(reply(req), convey.ShouldNotBeNil)
+			udp.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+			_, _, err = udp.ReadFrom(make([]byte, 1500))
+			convey.So(optw.IsTimeout(err), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test invalid crypt config", func() {
+			_, err := NewDialer("127.0.0.1:2001", []byte(`{"crypt": "rot13", "key": "test key"}`))
+			convey.So(err, convey.ShouldNotBeNil)
+			_, err = NewDialer("127.0.0.1:2001", []byte(`{"crypt": "aes"}`))
+			convey.So(err, convey.ShouldNotBeNil)
+
+			d, err := NewDialer("127.0.0.1:2001", []byte(`{"key": "test key"}`))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(d.config.cipher(), convey.ShouldEqual, "aes")
+		})
+	})
+}
+
+func TestKCPNoise(t *testing.T) {
+	convey.Convey("test kcp noise handshake", t, func() {
+		l, err := NewListener("127.0.0.1:2001", []byte(`{"noise": true}`))
+		convey.So(err, convey.ShouldBeNil)
+		l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+			return info.Identity, nil
+		})
+		err = l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan optw.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				t.Error("err should be nil, got ", err)
+			}
+			accepted <- conn
+		}()
+
+		cfg := []byte(`{"noise": true, "noiseServerKey": "` + l.NoisePublicKey() + `"}`)
+		d, err := NewDialer("127.0.0.1:2001", cfg)
+		convey.So(err, convey.ShouldBeNil)
+		conn, err := d.Dial()
+		convey.So(err, convey.ShouldBeNil)
+		defer conn.Close()
+
+		sconn := <-accepted
+		convey.So(sconn, convey.ShouldNotBeNil)
+		defer sconn.Close()
+		convey.So(sconn.Identity(), convey.ShouldHaveLength, 64)
+
+		stream, err := conn.OpenStream()
+		convey.So(err, convey.ShouldBeNil)
+		defer stream.Close()
+		stream.Write([]byte("ping"))
+		sstream, err := sconn.AcceptStream()
+		convey.So(err, convey.ShouldBeNil)
+		defer sstream.Close()
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(sstream, buf)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(buf), convey.ShouldEqual, "ping")
+	})
+}
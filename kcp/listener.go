@@ -1,9 +1,11 @@
 package kcp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/internal/smuxconn"
 	"net"
 	"time"
 
@@ -13,56 +15,173 @@ import (
 
 var _ optw.Listener = &Listener{}
 
+const scheme = "kcp"
+
+func init() {
+	optw.Register(scheme,
+		func(addr string, cfg optw.Config) (optw.Listener, error) {
+			c := defaultConfig
+			err := cfg.Decode(&c)
+			if err != nil {
+				return nil, err
+			}
+			l, err := NewListenerWithConfig(addr, c)
+			if err != nil {
+				return nil, err
+			}
+			return l, nil
+		},
+		func(addr string, cfg optw.Config) (optw.Dialer, error) {
+			c := defaultConfig
+			err := cfg.Decode(&c)
+			if err != nil {
+				return nil, err
+			}
+			d, err := NewDialerWithConfig(addr, c)
+			if err != nil {
+				return nil, err
+			}
+			return d, nil
+		})
+}
+
 type Listener struct {
-	laddr  string
-	config KCPConfig
+	laddr   string
+	config  KCPConfig
+	noise   *optw.NoiseHandshake
+	options optw.Options
 	*kcpgo.Listener
-	authFn func(token string) bool
+	optw.ServerAuth
+	acceptor *optw.Acceptor
 }
 
-func (l *Listener) SetAuthFunc(f func(token string) bool) {
-	l.authFn = f
+// NewListener creates a listener, rawConfig is laid over the default config
+func NewListener(laddr string, rawConfig json.RawMessage) (*Listener, error) {
+	cfg, err := parseConfig(rawConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{laddr: laddr, config: cfg}, nil
 }
 
-func NewListener(laddr string, rawConfig json.RawMessage) *Listener {
-	l := &Listener{}
-	if len(rawConfig) <= 0 {
-		l.config = defaultConfig
-	} else {
-		cfg := KCPConfig{}
-		json.Unmarshal(rawConfig, &cfg)
-		l.config = cfg
+func NewListenerWithConfig(laddr string, cfg KCPConfig) (*Listener, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
 	}
+	return &Listener{laddr: laddr, config: cfg}, nil
+}
 
-	l.laddr = laddr
-	return l
+// SetOptions sets the options shared by the transports,
+// it takes effect on Listen
+func (l *Listener) SetOptions(opts ...optw.Option) {
+	l.options.Apply(opts...)
+	l.config.HandshakeConfig = l.options.Handshake(l.config.HandshakeConfig)
 }
 
 func (l *Listener) Listen() error {
-	kcpLis, err := kcpgo.ListenWithOptions(l.laddr, nil, 10, 3)
+	cfg := l.config
+	block, err := cfg.blockCrypt()
+	if err != nil {
+		return err
+	}
+
+	if cfg.Noise {
+		l.noise, err = cfg.NoiseHandshake()
+		if err != nil {
+			return err
+		}
+		err = l.noise.CheckServer(&l.ServerAuth)
+		if err != nil {
+			return err
+		}
+	}
+
+	kcpLis, err := l.listen(block)
 	if err != nil {
 		return err
 	}
-	kcpLis.SetReadBuffer(4194304)
-	kcpLis.SetWriteBuffer(4194304)
+	kcpLis.SetReadBuffer(cfg.Rcvbuf)
+	kcpLis.SetWriteBuffer(cfg.SndBuf)
 	l.Listener = kcpLis
+	l.acceptor = optw.NewAcceptor(cfg.Concurrency())
+	go l.acceptor.Serve(l.accept)
 	return nil
 }
 
-func (l *Listener) Accept() (optw.Conn, error) {
+// listen creates the kcp listener, with hello enabled its socket
+// answers the settings hellos
+func (l *Listener) listen(block kcpgo.BlockCrypt) (*kcpgo.Listener, error) {
 	cfg := l.config
+	if !cfg.Hello {
+		return kcpgo.ListenWithOptions(l.laddr, block, cfg.FecDataShards, cfg.FecParityShards)
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", l.laddr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	// the kcp listener can not reach the buffers through the hello conn
+	udp.SetReadBuffer(cfg.Rcvbuf)
+	udp.SetWriteBuffer(cfg.SndBuf)
+
+	kcpLis, err := kcpgo.ServeConn(block, cfg.FecDataShards, cfg.FecParityShards, &helloConn{PacketConn: udp, config: cfg, key: cfg.cryptKey()})
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	return kcpLis, nil
+}
+
+// Accept returns the next connection which passed the handshake,
+// a failed handshake is returned as error and the listener keeps accepting.
+func (l *Listener) Accept() (optw.Conn, error) {
+	return l.acceptor.Accept()
+}
+
+func (l *Listener) AcceptContext(ctx context.Context) (optw.Conn, error) {
+	return l.acceptor.AcceptContext(ctx)
+}
+
+func (l *Listener) accept() (func() (optw.Conn, error), error) {
 	conn, err := l.Listener.AcceptKCP()
 	if err != nil {
 		return nil, err
 	}
 
-	if l.authFn != nil {
-		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-		err := optw.VerifyAuth(conn, l.authFn)
+	return func() (optw.Conn, error) {
+		return l.handshake(conn)
+	}, nil
+}
+
+func (l *Listener) handshake(conn *kcpgo.UDPSession) (optw.Conn, error) {
+	cfg := l.config
+	var err error
+	var identity interface{}
+	var stream net.Conn = conn
+	info := &optw.AuthInfo{RemoteAddr: conn.RemoteAddr(), Scheme: scheme}
+	switch {
+	case l.noise != nil:
+		deadline := time.Now().Add(cfg.Timeout())
+		conn.SetReadDeadline(deadline)
+		stream, identity, err = l.noise.Server(conn, &l.ServerAuth, info)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("auth fail: %w", optw.HandshakeError(err, deadline))
+		}
+	case l.ServerAuth.Enabled():
+		deadline := time.Now().Add(cfg.Timeout())
+		conn.SetReadDeadline(deadline)
+		identity, err = optw.VerifyAuth(conn, &l.ServerAuth, info)
 		conn.SetReadDeadline(time.Time{})
 		if err != nil {
 			conn.Close()
-			return nil, fmt.Errorf("auth fail: %v", err)
+			return nil, fmt.Errorf("auth fail: %w", optw.HandshakeError(err, deadline))
 		}
 	}
 
@@ -74,15 +193,19 @@ func (l *Listener) Accept() (optw.Conn, error) {
 	conn.SetACKNoDelay(cfg.AckNoDelay)
 	conn.SetReadBuffer(cfg.Rcvbuf)
 	conn.SetWriteBuffer(cfg.SndBuf)
-	mux, err := smux.Server(conn, nil)
+	mux, err := smux.Server(stream, smuxconn.Config(0, 0, l.options))
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	return &Conn{mux: mux}, nil
+	return smuxconn.New(mux, identity, info.Metadata), nil
 }
 
 func (l *Listener) Close() error {
+	if l.acceptor != nil {
+		l.acceptor.Close()
+	}
 	return l.Listener.Close()
 }
 
@@ -0,0 +1,37 @@
+package kcp
+
+import (
+	"context"
+	"github.com/ICKelin/optw"
+	"net"
+	"time"
+)
+
+// NoisePublicKey returns the hex noise static public key
+// of a listening listener, empty without noise
+func (l *Listener) NoisePublicKey() string {
+	if l.noise == nil {
+		return ""
+	}
+	return l.noise.PublicKey()
+}
+
+// noiseHandshake runs the noise handshake over conn in place of
+// the token handshake, conn is closed on failure
+func (dialer *Dialer) noiseHandshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	noise, err := dialer.config.NoiseHandshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	deadline := dialer.deadline(ctx)
+	conn.SetDeadline(deadline)
+	noiseConn, err := noise.Client(conn, dialer.accessToken, dialer.metadata)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, optw.HandshakeError(err, deadline)
+	}
+	return noiseConn, nil
+}
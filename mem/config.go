@@ -0,0 +1,30 @@
+package mem
+
+import (
+	"time"
+
+	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/internal/smuxconn"
+	"github.com/xtaci/smux"
+)
+
+type Config struct {
+	// smux keepalive in seconds
+	KeepAliveInterval int `json:"keepAliveInterval"`
+	KeepAliveTimeout  int `json:"keepAliveTimeout"`
+	optw.HandshakeConfig
+}
+
+var defaultConfig = Config{
+	KeepAliveInterval: 3,
+	KeepAliveTimeout:  10,
+	HandshakeConfig:   optw.DefaultHandshakeConfig,
+}
+
+// smuxConfig returns the smux config, the keepalive options
+// take precedence over the configured keepalive
+func (c Config) smuxConfig(opts optw.Options) *smux.Config {
+	return smuxconn.Config(
+		time.Second*time.Duration(c.KeepAliveInterval),
+		time.Second*time.Duration(c.KeepAliveTimeout), opts)
+}
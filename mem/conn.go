@@ -0,0 +1,29 @@
+package mem
+
+import "net"
+
+// Addr is the address of an in-memory endpoint
+type Addr string
+
+func (a Addr) Network() string {
+	return scheme
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+// pipeConn is one end of a net.Pipe with the endpoint addresses
+type pipeConn struct {
+	net.Conn
+	local  Addr
+	remote Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,253 @@
+// Package mem is an in-memory transport for tests, listeners are
+// named in the process and dialers connect to them through pipes.
+// It runs the same auth handshake and smux as the network transports.
+package mem
+
+import (
+	"context"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/internal/smuxconn"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+var _ optw.Listener = &Listener{}
+var _ optw.Dialer = &Dialer{}
+
+const scheme = "mem"
+
+var (
+	listenersMu sync.Mutex
+	listeners   = make(map[string]*Listener)
+
+	clientSeq uint64
+)
+
+func init() {
+	optw.RegisterConfig(scheme, defaultConfig, NewListenerWithConfig, NewDialerWithConfig)
+}
+
+type Dialer struct {
+	name        string
+	config      Config
+	accessToken string
+	metadata    map[string]string
+	options     optw.Options
+}
+
+// NewDialer creates a dialer of the listener named name
+func NewDialer(name string) *Dialer {
+	return NewDialerWithConfig(name, defaultConfig)
+}
+
+func NewDialerWithConfig(name string, cfg Config) *Dialer {
+	return &Dialer{name: name, config: cfg}
+}
+
+func (d *Dialer) SetAccessToken(accessToken string) {
+	d.accessToken = accessToken
+}
+
+func (d *Dialer) SetMetadata(md map[string]string) {
+	d.metadata = md
+}
+
+// SetOptions sets the options shared by the transports
+func (d *Dialer) SetOptions(opts ...optw.Option) {
+	d.options.Apply(opts...)
+	d.config.HandshakeConfig = d.options.Handshake(d.config.HandshakeConfig)
+}
+
+func (d *Dialer) Dial() (optw.Conn, error) {
+	return d.DialContext(context.Background())
+}
+
+func (d *Dialer) DialContext(ctx context.Context) (optw.Conn, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	listenersMu.Lock()
+	l, ok := listeners[d.name]
+	listenersMu.Unlock()
+	if !ok {
+		return nil, refused(d.name)
+	}
+
+	local := Addr(fmt.Sprintf("%s#%d", d.name, atomic.AddUint64(&clientSeq, 1)))
+	c, s := net.Pipe()
+	var conn net.Conn = &pipeConn{Conn: c, local: local, remote: Addr(d.name)}
+	deadline := time.Now().Add(d.config.Timeout())
+	wait := time.Until(deadline)
+	if d.options.DialTimeout > 0 {
+		wait = d.options.DialTimeout
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case l.conns <- &pipeConn{Conn: s, local: Addr(d.name), remote: local}:
+	case <-l.done:
+		conn.Close()
+		return nil, refused(d.name)
+	case <-timer.C:
+		conn.Close()
+		return nil, optw.Wrap(optw.ErrHandshakeTimeout, fmt.Errorf("mem: dial %s: listener busy", d.name))
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	// enable auth
+	if len(d.accessToken) > 0 {
+		var release func() error
+		conn, release = optw.WithContext(ctx, conn)
+		conn.SetDeadline(deadline)
+		err := d.options.AuthRequest(conn, d.accessToken, d.metadata)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, optw.ContextError(ctx, optw.HandshakeError(err, deadline))
+		}
+		err = release()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	mux, err := smux.Client(conn, d.config.smuxConfig(d.options))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return smuxconn.New(mux, nil, d.metadata), nil
+}
+
+func refused(name string) error {
+	return &net.OpError{Op: "dial", Net: scheme, Addr: Addr(name), Err: fmt.Errorf("connection refused")}
+}
+
+type Listener struct {
+	name      string
+	config    Config
+	conns     chan *pipeConn
+	done      chan struct{}
+	closeOnce sync.Once
+	options   optw.Options
+	optw.ServerAuth
+	acceptor *optw.Acceptor
+}
+
+// NewListener creates a listener named name, dialers of the
+// same process connect to it once listening
+func NewListener(name string) *Listener {
+	return NewListenerWithConfig(name, defaultConfig)
+}
+
+func NewListenerWithConfig(name string, cfg Config) *Listener {
+	return &Listener{
+		name:   name,
+		config: cfg,
+		conns:  make(chan *pipeConn),
+		done:   make(chan struct{}),
+	}
+}
+
+// SetOptions sets the options shared by the transports,
+// it takes effect on Listen
+func (l *Listener) SetOptions(opts ...optw.Option) {
+	l.options.Apply(opts...)
+	l.config.HandshakeConfig = l.options.Handshake(l.config.HandshakeConfig)
+}
+
+func (l *Listener) Listen() error {
+	select {
+	case <-l.done:
+		return net.ErrClosed
+	default:
+	}
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if _, ok := listeners[l.name]; ok {
+		return &net.OpError{Op: "listen", Net: scheme, Addr: Addr(l.name),
+			Err: fmt.Errorf("address already in use")}
+	}
+
+	listeners[l.name] = l
+	l.acceptor = optw.NewAcceptor(l.config.Concurrency())
+	go l.acceptor.Serve(l.accept)
+	return nil
+}
+
+// Accept returns the next connection which passed the handshake,
+// a failed handshake is returned as error and the listener keeps accepting.
+func (l *Listener) Accept() (optw.Conn, error) {
+	return l.acceptor.Accept()
+}
+
+func (l *Listener) AcceptContext(ctx context.Context) (optw.Conn, error) {
+	return l.acceptor.AcceptContext(ctx)
+}
+
+func (l *Listener) accept() (func() (optw.Conn, error), error) {
+	select {
+	case conn := <-l.conns:
+		return func() (optw.Conn, error) {
+			return l.handshake(conn)
+		}, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) handshake(conn *pipeConn) (optw.Conn, error) {
+	// enable auth
+	var identity interface{}
+	var err error
+	info := &optw.AuthInfo{RemoteAddr: conn.RemoteAddr(), Scheme: scheme}
+	if l.ServerAuth.Enabled() {
+		deadline := time.Now().Add(l.config.Timeout())
+		conn.SetDeadline(deadline)
+		identity, err = optw.VerifyAuth(conn, &l.ServerAuth, info)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("auth fail: %w", optw.HandshakeError(err, deadline))
+		}
+	}
+
+	mux, err := smux.Server(conn, l.config.smuxConfig(l.options))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return smuxconn.New(mux, identity, info.Metadata), nil
+}
+
+// Close stops listening, the name can be listened again
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		listenersMu.Lock()
+		if listeners[l.name] == l {
+			delete(listeners, l.name)
+		}
+		listenersMu.Unlock()
+	})
+	if l.acceptor != nil {
+		l.acceptor.Close()
+	}
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return Addr(l.name)
+}
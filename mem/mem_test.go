@@ -0,0 +1,197 @@
+package mem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"github.com/smartystreets/goconvey/convey"
+	"github.com/xtaci/smux"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemAuth(t *testing.T) {
+	t.Parallel()
+	convey.Convey("test optw transport/mem auth", t, func() {
+		l := NewListener("test-mem-auth")
+		l.SetAccessToken("test auth")
+		l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+			return info.Metadata["clientId"], nil
+		})
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		convey.Convey("test auth success", func() {
+			d := NewDialer("test-mem-auth")
+			d.SetAccessToken("test auth")
+			d.SetMetadata(map[string]string{"clientId": "client-1"})
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			convey.So(sconn.Identity(), convey.ShouldEqual, "client-1")
+			convey.So(sconn.RemoteAddr().String(), convey.ShouldEqual, conn.LocalAddr().String())
+			convey.So(sconn.LocalAddr().String(), convey.ShouldEqual, "test-mem-auth")
+		})
+
+		convey.Convey("test auth fail", func() {
+			d := NewDialer("test-mem-auth")
+			d.SetAccessToken("invalid test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+
+			_, err = l.Accept()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test per tenant secrets", func() {
+			secrets := map[string]string{"tenant-1": "secret 1", "tenant-2": "secret 2"}
+			l.SetSecretFunc(func(keyID string) (string, error) {
+				secret, ok := secrets[keyID]
+				if !ok {
+					return "", fmt.Errorf("unknown tenant")
+				}
+				return secret, nil
+			})
+			l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+				return info.KeyID, nil
+			})
+
+			for tenant, secret := range secrets {
+				d := NewDialer("test-mem-auth")
+				d.SetAccessToken(secret)
+				d.SetMetadata(map[string]string{optw.MetadataKeyID: tenant})
+				conn, err := d.Dial()
+				convey.So(err, convey.ShouldBeNil)
+				defer conn.Close()
+
+				sconn, err := l.Accept()
+				convey.So(err, convey.ShouldBeNil)
+				defer sconn.Close()
+				convey.So(sconn.Identity(), convey.ShouldEqual, tenant)
+			}
+
+			d := NewDialer("test-mem-auth")
+			d.SetAccessToken("secret 1")
+			d.SetMetadata(map[string]string{optw.MetadataKeyID: "tenant-2"})
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+	})
+}
+
+func TestMemConn(t *testing.T) {
+	t.Parallel()
+	convey.Convey("test optw transport/mem conn", t, func() {
+		l := NewListener("test-mem-conn")
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		conn, err := NewDialer("test-mem-conn").Dial()
+		convey.So(err, convey.ShouldBeNil)
+		defer conn.Close()
+		sconn, err := l.Accept()
+		convey.So(err, convey.ShouldBeNil)
+		defer sconn.Close()
+
+		convey.Convey("test streams", func() {
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer stream.Close()
+			stream.Write([]byte("ping"))
+
+			sstream, err := sconn.AcceptStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer sstream.Close()
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(sstream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+		})
+
+		convey.Convey("test deadline", func() {
+			sconn.SetDeadline(time.Now().Add(time.Millisecond * 50))
+			_, err := sconn.AcceptStream()
+			convey.So(err, convey.ShouldEqual, smux.ErrTimeout)
+		})
+
+		convey.Convey("test context", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			_, err := sconn.AcceptStreamContext(ctx)
+			convey.So(errors.Is(err, context.DeadlineExceeded), convey.ShouldBeTrue)
+
+			stream, err := conn.OpenStreamContext(context.Background())
+			convey.So(err, convey.ShouldBeNil)
+			defer stream.Close()
+			sstream, err := sconn.AcceptStreamContext(context.Background())
+			convey.So(err, convey.ShouldBeNil)
+			defer sstream.Close()
+
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+			_, err = conn.OpenStreamContext(ctx)
+			convey.So(errors.Is(err, context.Canceled), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test close", func() {
+			conn.Close()
+			convey.So(conn.IsClosed(), convey.ShouldBeTrue)
+			_, err := conn.OpenStream()
+			convey.So(errors.Is(err, optw.ErrConnClosed), convey.ShouldBeTrue)
+
+			_, err = sconn.AcceptStream()
+			convey.So(errors.Is(err, optw.ErrConnClosed), convey.ShouldBeTrue)
+		})
+	})
+}
+
+func TestMemListener(t *testing.T) {
+	t.Parallel()
+	convey.Convey("test optw transport/mem listener", t, func() {
+		convey.Convey("test dial unknown listener", func() {
+			_, err := NewDialer("test-mem-unknown").Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test name in use", func() {
+			l := NewListener("test-mem-listener")
+			convey.So(l.Listen(), convey.ShouldBeNil)
+			convey.So(NewListener("test-mem-listener").Listen(), convey.ShouldNotBeNil)
+
+			l.Close()
+			_, err := l.Accept()
+			convey.So(errors.Is(err, net.ErrClosed), convey.ShouldBeTrue)
+			_, err = NewDialer("test-mem-listener").Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+
+			l = NewListener("test-mem-listener")
+			convey.So(l.Listen(), convey.ShouldBeNil)
+			l.Close()
+		})
+
+		convey.Convey("test accept context", func() {
+			l := NewListener("test-mem-accept-context")
+			convey.So(l.Listen(), convey.ShouldBeNil)
+			defer l.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			_, err := l.AcceptContext(ctx)
+			convey.So(errors.Is(err, context.DeadlineExceeded), convey.ShouldBeTrue)
+
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+			_, err = NewDialer("test-mem-accept-context").DialContext(ctx)
+			convey.So(errors.Is(err, context.Canceled), convey.ShouldBeTrue)
+		})
+	})
+}
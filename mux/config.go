@@ -0,0 +1,75 @@
+package mux
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/internal/smuxconn"
+	"github.com/xtaci/smux"
+)
+
+type Config struct {
+	// smux keepalive in seconds
+	KeepAliveInterval int `json:"keepAliveInterval"`
+	KeepAliveTimeout  int `json:"keepAliveTimeout"`
+	// wrap the tcp connection in tls, the default of mux+tls
+	TLS bool `json:"tls"`
+	// octal file mode of the listener unix socket, eg: 0660
+	SocketMode string `json:"socketMode"`
+	optw.HandshakeConfig
+	optw.TLSConfig
+	optw.ObfsConfig
+	optw.PSKConfig
+	optw.NoiseConfig
+	optw.ProxyConfig
+}
+
+var defaultConfig = Config{
+	KeepAliveInterval: 3,
+	KeepAliveTimeout:  10,
+	HandshakeConfig:   optw.DefaultHandshakeConfig,
+}
+
+var defaultTLSConfig = Config{
+	KeepAliveInterval: 3,
+	KeepAliveTimeout:  10,
+	TLS:               true,
+	HandshakeConfig:   optw.DefaultHandshakeConfig,
+}
+
+// DefaultConfig returns the default config of scheme mux or mux+tls
+func DefaultConfig(withTLS bool) Config {
+	if withTLS {
+		return defaultTLSConfig
+	}
+	return defaultConfig
+}
+
+func (c Config) scheme() string {
+	if c.TLS {
+		return tlsScheme
+	}
+	return scheme
+}
+
+// tlsConfig returns conf, or the one built from the TLSConfig if conf is nil,
+// addr is the server address of a dialer and empty for a listener
+func (c Config) tlsConfig(conf *tls.Config, addr string) (*tls.Config, error) {
+	if conf != nil {
+		return conf, nil
+	}
+
+	if len(addr) <= 0 {
+		return c.ServerTLS(nil)
+	}
+	return c.ClientTLS(addr, nil)
+}
+
+// smuxConfig returns the smux config, the keepalive options
+// take precedence over the configured keepalive
+func (c Config) smuxConfig(opts optw.Options) *smux.Config {
+	return smuxconn.Config(
+		time.Second*time.Duration(c.KeepAliveInterval),
+		time.Second*time.Duration(c.KeepAliveTimeout), opts)
+}
@@ -1,8 +1,11 @@
 package mux
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/internal/smuxconn"
 	"net"
 	"time"
 
@@ -13,135 +16,315 @@ var _ optw.Listener = &Listener{}
 var _ optw.Dialer = &Dialer{}
 var _ optw.Conn = &Conn{}
 
+const (
+	scheme    = "mux"
+	tlsScheme = "mux+tls"
+)
+
+func init() {
+	optw.RegisterConfig(scheme, defaultConfig, NewListenerWithConfig, NewDialerWithConfig)
+	optw.RegisterConfig(tlsScheme, defaultTLSConfig, NewListenerWithConfig, NewDialerWithConfig)
+}
+
 type Dialer struct {
 	remote      string
+	config      Config
+	tlsConfig   *tls.Config
 	accessToken string
+	metadata    map[string]string
+	options     optw.Options
 }
 
 func (d *Dialer) SetAccessToken(accessToken string) {
 	d.accessToken = accessToken
 }
 
-type Listener struct {
-	laddr string
-	net.Listener
-	authFn func(token string) bool
+func (d *Dialer) SetMetadata(md map[string]string) {
+	d.metadata = md
 }
 
-type Conn struct {
-	mux *smux.Session
+// SetOptions sets the options shared by the transports
+func (d *Dialer) SetOptions(opts ...optw.Option) {
+	d.options.Apply(opts...)
+	d.config.HandshakeConfig = d.options.Handshake(d.config.HandshakeConfig)
 }
 
-func (c *Conn) OpenStream() (optw.Stream, error) {
-	stream, err := c.mux.OpenStream()
-	if err != nil {
-		return nil, err
-	}
-
-	return stream, nil
-}
-
-func (c *Conn) AcceptStream() (optw.Stream, error) {
-	return c.mux.AcceptStream()
+type Listener struct {
+	laddr     string
+	config    Config
+	tlsConfig *tls.Config
+	serverTLS *tls.Config
+	noise     *optw.NoiseHandshake
+	options   optw.Options
+	net.Listener
+	optw.ServerAuth
+	acceptor *optw.Acceptor
 }
 
-func (c *Conn) Close() {
-	c.mux.Close()
-}
+// Conn is the connection of the dialers and listeners
+type Conn = smuxconn.Conn
 
-func (c *Conn) IsClosed() bool {
-	return c.mux.IsClosed()
+func NewDialer(remote string) optw.Dialer {
+	return NewDialerWithConfig(remote, defaultConfig)
 }
 
-func (c *Conn) RemoteAddr() net.Addr {
-	return c.mux.RemoteAddr()
+func NewDialerWithConfig(remote string, cfg Config) *Dialer {
+	return &Dialer{remote: remote, config: cfg}
 }
 
-func (c *Conn) LocalAddr() net.Addr {
-	return c.mux.LocalAddr()
+func (d *Dialer) Dial() (optw.Conn, error) {
+	return d.DialContext(context.Background())
 }
 
-func (c *Conn) SetDeadline(t time.Time) error {
-	return c.mux.SetDeadline(t)
-}
+func (d *Dialer) DialContext(ctx context.Context) (optw.Conn, error) {
+	network, addr := splitNetwork(d.remote)
+	dialer, err := d.options.NetDialer(network)
+	if err != nil {
+		return nil, err
+	}
+	var raw net.Conn
+	switch {
+	case d.config.ProxyEnabled() && network != "tcp":
+		return nil, fmt.Errorf("proxy is not supported on %s", network)
+	case d.config.ProxyEnabled():
+		raw, err = d.config.ProxyDial(ctx, dialer, addr, d.config.Timeout())
+	default:
+		raw, err = dialer.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-func NewDialer(remote string) optw.Dialer {
-	return &Dialer{remote: remote}
-}
+	conn, release := optw.WithContext(ctx, raw)
+	conn, err = d.handshake(conn)
+	if err != nil {
+		return nil, optw.ContextError(ctx, err)
+	}
+	err = release()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-func (d *Dialer) Dial() (optw.Conn, error) {
-	conn, err := net.Dial("tcp", d.remote)
+	mux, err := smux.Client(conn, d.config.smuxConfig(d.options))
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	// enable auth
-	if len(d.accessToken) > 0 {
-		conn.SetDeadline(time.Now().Add(time.Second * 5))
-		err = optw.AuthRequest(conn, d.accessToken)
+	return smuxconn.New(mux, nil, d.metadata), nil
+}
+
+// handshake runs the handshakes of the enabled layers over conn,
+// conn is closed on failure
+func (d *Dialer) handshake(conn net.Conn) (net.Conn, error) {
+	var err error
+	if d.config.ObfsEnabled() {
+		deadline := time.Now().Add(d.config.Timeout())
+		conn.SetDeadline(deadline)
+		obfsConn, err := d.config.ObfsClient(conn)
 		conn.SetDeadline(time.Time{})
 		if err != nil {
 			conn.Close()
+			return nil, optw.HandshakeError(err, deadline)
+		}
+		conn = obfsConn
+	}
+
+	if d.config.TLS {
+		conn, err = d.clientTLS(conn)
+		if err != nil {
 			return nil, err
 		}
 	}
 
-	cfg := smux.DefaultConfig()
-	cfg.KeepAliveTimeout = time.Second * 10
-	cfg.KeepAliveInterval = time.Second * 3
-	mux, err := smux.Client(conn, cfg)
-	if err != nil {
-		return nil, err
+	if d.config.PSKEnabled() {
+		deadline := time.Now().Add(d.config.Timeout())
+		conn.SetDeadline(deadline)
+		pskConn, err := d.config.PSKClient(conn)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, optw.HandshakeError(err, deadline)
+		}
+		conn = pskConn
+	}
+
+	// enable auth
+	switch {
+	case d.config.Noise:
+		conn, err = d.noiseHandshake(conn)
+		if err != nil {
+			return nil, err
+		}
+	case len(d.accessToken) > 0:
+		deadline := time.Now().Add(d.config.Timeout())
+		conn.SetDeadline(deadline)
+		err = d.options.AuthRequest(conn, d.accessToken, d.metadata)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, optw.HandshakeError(err, deadline)
+		}
 	}
 
-	return &Conn{mux: mux}, nil
+	return conn, nil
 }
 
 func NewListener(laddr string) *Listener {
-	return &Listener{laddr: laddr}
+	return NewListenerWithConfig(laddr, defaultConfig)
 }
 
+func NewListenerWithConfig(laddr string, cfg Config) *Listener {
+	return &Listener{laddr: laddr, config: cfg}
+}
+
+// SetOptions sets the options shared by the transports,
+// it takes effect on Listen
+func (l *Listener) SetOptions(opts ...optw.Option) {
+	l.options.Apply(opts...)
+	l.config.HandshakeConfig = l.options.Handshake(l.config.HandshakeConfig)
+}
+
+// Accept returns the next connection which passed the handshake,
+// a failed handshake is returned as error and the listener keeps accepting.
 func (l *Listener) Accept() (optw.Conn, error) {
+	return l.acceptor.Accept()
+}
+
+func (l *Listener) AcceptContext(ctx context.Context) (optw.Conn, error) {
+	return l.acceptor.AcceptContext(ctx)
+}
+
+func (l *Listener) accept() (func() (optw.Conn, error), error) {
 	conn, err := l.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
 
+	return func() (optw.Conn, error) {
+		return l.handshake(conn)
+	}, nil
+}
+
+func (l *Listener) handshake(conn net.Conn) (optw.Conn, error) {
+	var identity interface{}
+	var err error
+	info := &optw.AuthInfo{
+		RemoteAddr: conn.RemoteAddr(),
+		Scheme:     l.config.scheme(),
+		PeerCred:   peerCred(conn),
+	}
+	if l.config.ObfsEnabled() {
+		deadline := time.Now().Add(l.config.Timeout())
+		conn.SetDeadline(deadline)
+		obfsConn, err := l.config.ObfsServer(conn)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("obfs handshake fail: %w", optw.HandshakeError(err, deadline))
+		}
+		conn = obfsConn
+	}
+	if l.config.TLS {
+		conn, err = l.acceptTLS(conn, info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if l.config.PSKEnabled() {
+		deadline := time.Now().Add(l.config.Timeout())
+		conn.SetDeadline(deadline)
+		pskConn, err := l.config.PSKServer(conn)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("psk handshake fail: %w", optw.HandshakeError(err, deadline))
+		}
+		conn = pskConn
+	}
+
 	// enable auth
-	if l.authFn != nil {
-		conn.SetDeadline(time.Now().Add(time.Second * 5))
-		err := optw.VerifyAuth(conn, l.authFn)
+	switch {
+	case l.noise != nil:
+		deadline := time.Now().Add(l.config.Timeout())
+		conn.SetDeadline(deadline)
+		noiseConn, noiseIdentity, err := l.noise.Server(conn, &l.ServerAuth, info)
 		conn.SetDeadline(time.Time{})
 		if err != nil {
 			conn.Close()
-			return nil, fmt.Errorf("auth fail: %v", err)
+			return nil, fmt.Errorf("auth fail: %w", optw.HandshakeError(err, deadline))
+		}
+		conn, identity = noiseConn, noiseIdentity
+	case (info.Certificate != nil || info.PeerCred != nil) && !l.ServerAuth.TokenEnabled():
+		identity, err = optw.VerifyPeer(&l.ServerAuth, info)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("auth fail: %w", err)
+		}
+		conn = &peerConn{Conn: conn, info: info, timeout: l.config.Timeout()}
+	case l.ServerAuth.Enabled():
+		deadline := time.Now().Add(l.config.Timeout())
+		conn.SetDeadline(deadline)
+		identity, err = optw.VerifyAuth(conn, &l.ServerAuth, info)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("auth fail: %w", optw.HandshakeError(err, deadline))
 		}
 	}
-	cfg := smux.DefaultConfig()
-	cfg.KeepAliveTimeout = time.Second * 10
-	cfg.KeepAliveInterval = time.Second * 3
-	mux, err := smux.Server(conn, cfg)
+	mux, err := smux.Server(conn, l.config.smuxConfig(l.options))
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	return &Conn{mux: mux}, nil
+	return smuxconn.New(mux, identity, info.Metadata), nil
 }
 
 func (l *Listener) Close() error {
+	if l.acceptor != nil {
+		l.acceptor.Close()
+	}
 	return l.Listener.Close()
 }
 
 func (l *Listener) Listen() error {
-	listener, err := net.Listen("tcp", l.laddr)
+	if l.config.TLS {
+		serverTLS, err := l.config.tlsConfig(l.tlsConfig, "")
+		if err != nil {
+			return err
+		}
+		l.serverTLS = serverTLS
+	}
+
+	if l.config.Noise {
+		noise, err := l.config.NoiseHandshake()
+		if err != nil {
+			return err
+		}
+		err = noise.CheckServer(&l.ServerAuth)
+		if err != nil {
+			return err
+		}
+		l.noise = noise
+	}
+
+	var listener net.Listener
+	var err error
+	network, addr := splitNetwork(l.laddr)
+	if network == "unix" {
+		listener, err = listenUnix(addr, l.config.SocketMode)
+	} else {
+		listener, err = net.Listen(network, addr)
+	}
 	if err != nil {
 		return err
 	}
 
 	l.Listener = listener
+	l.acceptor = optw.NewAcceptor(l.config.Concurrency())
+	go l.acceptor.Serve(l.accept)
 	return nil
 }
-
-func (l *Listener) SetAuthFunc(f func(token string) bool) {
-	l.authFn = f
-}
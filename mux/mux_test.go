@@ -1,7 +1,18 @@
 package mux
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ICKelin/optw"
 	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,6 +31,8 @@ func TestMux(t *testing.T) {
 			defer l.Close()
 			d := NewDialer("127.0.0.1:2001")
 			d.SetAccessToken("test auth")
+			// the auth func checks the plaintext token
+			d.SetOptions(optw.WithLegacyAuth(true))
 
 			go func() {
 				_, err := l.Accept()
@@ -46,17 +59,19 @@ func TestMux(t *testing.T) {
 			defer l.Close()
 			d := NewDialer("127.0.0.1:2001")
 			d.SetAccessToken("invalid test auth")
+			// the auth func checks the plaintext token
+			d.SetOptions(optw.WithLegacyAuth(true))
 
 			go func() {
 				_, err := l.Accept()
-				if err == nil {
-					t.Error("err should not be nil")
+				if !errors.Is(err, optw.ErrAuthFailed) {
+					t.Error("err should be ErrAuthFailed, got ", err)
 				}
 			}()
 
 			time.Sleep(time.Second * 1)
 			_, err := d.Dial()
-			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
 		})
 
 		convey.Convey("no auth test", func() {
@@ -79,5 +94,624 @@ func TestMux(t *testing.T) {
 			convey.So(err, convey.ShouldBeNil)
 			defer conn.Close()
 		})
+
+		convey.Convey("test auth handler identity and metadata", func() {
+			l := NewListener("127.0.0.1:2001")
+			l.SetAccessToken("test auth")
+			l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+				return info.Scheme + "/tenant-1", nil
+			})
+			l.Listen()
+			defer l.Close()
+			d := NewDialer("127.0.0.1:2001")
+			d.SetAccessToken("test auth")
+			d.SetMetadata(map[string]string{"clientId": "client-1"})
+
+			accepted := make(chan optw.Conn, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					t.Error("err should be nil, got ", err)
+				}
+				accepted <- conn
+			}()
+
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+			convey.So(conn.Identity(), convey.ShouldBeNil)
+
+			sconn := <-accepted
+			convey.So(sconn, convey.ShouldNotBeNil)
+			defer sconn.Close()
+			convey.So(sconn.Identity(), convey.ShouldEqual, "mux/tenant-1")
+			convey.So(sconn.Metadata()["clientId"], convey.ShouldEqual, "client-1")
+		})
+	})
+}
+
+func TestMuxHandshake(t *testing.T) {
+	convey.Convey("test optw transport/mux concurrent handshakes", t, func() {
+		convey.Convey("test silent client does not stall accept", func() {
+			cfg := defaultConfig
+			cfg.HandshakeTimeout = 1
+			l := NewListenerWithConfig("127.0.0.1:2001", cfg)
+			l.SetAccessToken("test auth")
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			silent, err := net.Dial("tcp", "127.0.0.1:2001")
+			convey.So(err, convey.ShouldBeNil)
+			defer silent.Close()
+
+			d := NewDialer("127.0.0.1:2001")
+			d.SetAccessToken("test auth")
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			begin := time.Now()
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second)
+
+			// the silent client fails with the handshake timeout
+			_, err = l.Accept()
+			convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second*2)
+		})
+
+		convey.Convey("test dial context gives up on a silent server", func() {
+			silent, err := net.Listen("tcp", "127.0.0.1:2001")
+			convey.So(err, convey.ShouldBeNil)
+			defer silent.Close()
+			go func() {
+				conn, err := silent.Accept()
+				if err == nil {
+					defer conn.Close()
+					io.Copy(io.Discard, conn)
+				}
+			}()
+
+			d := NewDialer("127.0.0.1:2001")
+			d.SetAccessToken("test auth")
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			defer cancel()
+			begin := time.Now()
+			_, err = d.DialContext(ctx)
+			convey.So(errors.Is(err, context.DeadlineExceeded), convey.ShouldBeTrue)
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second)
+		})
+
+		convey.Convey("test accept after close", func() {
+			l := NewListener("127.0.0.1:2001")
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			l.Close()
+
+			_, err = l.Accept()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMuxTLS(t *testing.T) {
+	convey.Convey("test optw transport/mux+tls", t, func() {
+		dir := t.TempDir()
+		lcfg := DefaultConfig(true)
+		lcfg.CertFile = filepath.Join(dir, "cert.pem")
+		lcfg.KeyFile = filepath.Join(dir, "key.pem")
+		lcfg.GenerateCert = true
+		lcfg.ServerName = "optw.test"
+		l := NewListenerWithConfig("127.0.0.1:2005", lcfg)
+		l.SetAccessToken("test auth")
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan optw.Conn, 1)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if err == nil {
+					accepted <- conn
+				}
+			}
+		}()
+
+		convey.Convey("test verified server", func() {
+			cfg := DefaultConfig(true)
+			cfg.CAFile = lcfg.CertFile
+			cfg.ServerName = "optw.test"
+			d := NewDialerWithConfig("127.0.0.1:2005", cfg)
+			d.SetAccessToken("test auth")
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn := <-accepted
+			defer sconn.Close()
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer stream.Close()
+			stream.Write([]byte("ping"))
+			sstream, err := sconn.AcceptStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer sstream.Close()
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(sstream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+		})
+
+		convey.Convey("test pinned fingerprint mismatch", func() {
+			cfg := DefaultConfig(true)
+			cfg.Fingerprints = []string{strings.Repeat("00", 32)}
+			d := NewDialerWithConfig("127.0.0.1:2005", cfg)
+			d.SetAccessToken("test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrFingerprintMismatch), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test plaintext client", func() {
+			d := NewDialer("127.0.0.1:2005")
+			d.SetAccessToken("test auth")
+			_, err := d.Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test client certificate identity", func() {
+			certPEM, keyPEM, err := optw.GenerateCertificate([]string{"client-1"})
+			convey.So(err, convey.ShouldBeNil)
+			clientCert := filepath.Join(dir, "client.pem")
+			clientKey := filepath.Join(dir, "client.key")
+			convey.So(os.WriteFile(clientCert, certPEM, 0600), convey.ShouldBeNil)
+			convey.So(os.WriteFile(clientKey, keyPEM, 0600), convey.ShouldBeNil)
+
+			mcfg := lcfg
+			mcfg.ClientCAFile = clientCert
+			ml := NewListenerWithConfig("127.0.0.1:2006", mcfg)
+			err = ml.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer ml.Close()
+
+			cfg := DefaultConfig(true)
+			cfg.CAFile = lcfg.CertFile
+			cfg.ServerName = "optw.test"
+			cfg.CertFile = clientCert
+			cfg.KeyFile = clientKey
+			conn, err := NewDialerWithConfig("127.0.0.1:2006", cfg).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := ml.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			convey.So(sconn.Identity(), convey.ShouldEqual, "client-1")
+		})
+
+		convey.Convey("test token client of a peer authenticated listener", func() {
+			certPEM, keyPEM, err := optw.GenerateCertificate([]string{"client-1"})
+			convey.So(err, convey.ShouldBeNil)
+			clientCert := filepath.Join(dir, "client.pem")
+			clientKey := filepath.Join(dir, "client.key")
+			convey.So(os.WriteFile(clientCert, certPEM, 0600), convey.ShouldBeNil)
+			convey.So(os.WriteFile(clientKey, keyPEM, 0600), convey.ShouldBeNil)
+
+			mcfg := lcfg
+			mcfg.ClientCAFile = clientCert
+			ml := NewListenerWithConfig("127.0.0.1:2006", mcfg)
+			ml.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+				return info.Identity, nil
+			})
+			err = ml.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer ml.Close()
+
+			cfg := DefaultConfig(true)
+			cfg.CAFile = lcfg.CertFile
+			cfg.ServerName = "optw.test"
+			cfg.CertFile = clientCert
+			cfg.KeyFile = clientKey
+			d := NewDialerWithConfig("127.0.0.1:2006", cfg)
+			d.SetAccessToken("test auth")
+			_, err = d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+
+			// the auth request is not fed to smux
+			sconn, err := ml.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			_, err = sconn.AcceptStream()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMuxUnix(t *testing.T) {
+	convey.Convey("test optw transport/mux over unix socket", t, func() {
+		sock := filepath.Join(t.TempDir(), "optw.sock")
+
+		convey.Convey("test peer credentials and socket mode", func() {
+			cfg := defaultConfig
+			cfg.SocketMode = "0600"
+			l := NewListenerWithConfig("unix://"+sock, cfg)
+			l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+				if runtime.GOOS != "linux" {
+					return "no peer cred", nil
+				}
+				if info.PeerCred == nil || int(info.PeerCred.Uid) != os.Getuid() {
+					return nil, fmt.Errorf("unexpected peer %v", info.PeerCred)
+				}
+				return int(info.PeerCred.Pid), nil
+			})
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			fi, err := os.Stat(sock)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(fi.Mode().Perm(), convey.ShouldEqual, os.FileMode(0600))
+			// the private directory of the socket is removed
+			entries, err := os.ReadDir(filepath.Dir(sock))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(len(entries), convey.ShouldEqual, 1)
+
+			conn, err := NewDialer("unix://" + sock).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			if runtime.GOOS == "linux" {
+				convey.So(sconn.Identity(), convey.ShouldEqual, os.Getpid())
+			}
+
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer stream.Close()
+			stream.Write([]byte("ping"))
+			sstream, err := sconn.AcceptStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer sstream.Close()
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(sstream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+
+			l.Close()
+			_, err = os.Stat(sock)
+			convey.So(os.IsNotExist(err), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test stale socket cleanup", func() {
+			stale, err := net.Listen("unix", sock)
+			convey.So(err, convey.ShouldBeNil)
+			stale.(*net.UnixListener).SetUnlinkOnClose(false)
+			stale.Close()
+
+			l := NewListener("unix://" + sock)
+			err = l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			// the socket of a running listener is kept
+			err = NewListener("unix://" + sock).Listen()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test not a socket", func() {
+			convey.So(os.WriteFile(sock, nil, 0600), convey.ShouldBeNil)
+			err := NewListener("unix://" + sock).Listen()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMuxObfs(t *testing.T) {
+	convey.Convey("test optw transport/mux obfuscation", t, func() {
+		lcfg := defaultConfig
+		lcfg.ObfsKey = "obfs key"
+		lcfg.HandshakeTimeout = 1
+		l := NewListenerWithConfig("127.0.0.1:2011", lcfg)
+		l.SetAccessToken("test auth")
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		convey.Convey("test obfuscated client", func() {
+			d := NewDialerWithConfig("127.0.0.1:2011", lcfg)
+			d.SetAccessToken("test auth")
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer stream.Close()
+			stream.Write([]byte("ping"))
+			sstream, err := sconn.AcceptStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer sstream.Close()
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(sstream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+		})
+
+		convey.Convey("test silent to plaintext client", func() {
+			cfg := defaultConfig
+			cfg.HandshakeTimeout = 1
+			d := NewDialerWithConfig("127.0.0.1:2011", cfg)
+			d.SetAccessToken("test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+
+			// the auth hello is shorter than an obfuscated hello
+			_, err = l.Accept()
+			convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test silent to wrong key", func() {
+			cfg := lcfg
+			cfg.ObfsKey = "invalid key"
+			d := NewDialerWithConfig("127.0.0.1:2011", cfg)
+			d.SetAccessToken("test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+
+			_, err = l.Accept()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+	})
+}
+
+func TestMuxPSK(t *testing.T) {
+	convey.Convey("test optw transport/mux psk encryption", t, func() {
+		lcfg := defaultConfig
+		lcfg.PSK = "test psk"
+		lcfg.PSKCipher = optw.CipherAES256GCM
+		l := NewListenerWithConfig("127.0.0.1:2012", lcfg)
+		l.SetAccessToken("test auth")
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		convey.Convey("test encrypted client", func() {
+			d := NewDialerWithConfig("127.0.0.1:2012", lcfg)
+			d.SetAccessToken("test auth")
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer stream.Close()
+			stream.Write([]byte("ping"))
+			sstream, err := sconn.AcceptStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer sstream.Close()
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(sstream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+		})
+
+		convey.Convey("test wrong psk", func() {
+			cfg := lcfg
+			cfg.PSK = "invalid psk"
+			d := NewDialerWithConfig("127.0.0.1:2012", cfg)
+			d.SetAccessToken("test auth")
+			_, err := d.Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+
+			_, err = l.Accept()
+			convey.So(errors.Is(err, optw.ErrFrameAuth), convey.ShouldBeTrue)
+		})
+	})
+}
+
+func TestMuxNoise(t *testing.T) {
+	convey.Convey("test optw transport/mux noise handshake", t, func() {
+		dir := t.TempDir()
+		lcfg := defaultConfig
+		lcfg.Noise = true
+		lcfg.NoiseKeyFile = filepath.Join(dir, "server.key")
+		lcfg.GenerateNoiseKey = true
+		l := NewListenerWithConfig("127.0.0.1:2013", lcfg)
+		l.SetAccessToken("test auth")
+		l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+			return info.Identity, nil
+		})
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		convey.Convey("test client key identity", func() {
+			cfg := defaultConfig
+			cfg.Noise = true
+			cfg.NoiseKeyFile = filepath.Join(dir, "client.key")
+			cfg.GenerateNoiseKey = true
+			cfg.NoiseServerKey = l.NoisePublicKey()
+			d := NewDialerWithConfig("127.0.0.1:2013", cfg)
+			d.SetAccessToken("test auth")
+			d.SetMetadata(map[string]string{"clientId": "client-1"})
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			noise, err := cfg.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(sconn.Identity(), convey.ShouldEqual, noise.PublicKey())
+			convey.So(sconn.Metadata()["clientId"], convey.ShouldEqual, "client-1")
+
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer stream.Close()
+			stream.Write([]byte("ping"))
+			sstream, err := sconn.AcceptStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer sstream.Close()
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(sstream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+		})
+
+		convey.Convey("test wrong token", func() {
+			cfg := defaultConfig
+			cfg.Noise = true
+			cfg.NoiseServerKey = l.NoisePublicKey()
+			d := NewDialerWithConfig("127.0.0.1:2013", cfg)
+			d.SetAccessToken("invalid test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+
+			_, err = l.Accept()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test no auth configurations", func() {
+			cfg := defaultConfig
+			cfg.Noise = true
+			_, err := NewDialerWithConfig("127.0.0.1:2013", cfg).Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+
+			err = NewListenerWithConfig("127.0.0.1:0", cfg).Listen()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMuxOptions(t *testing.T) {
+	convey.Convey("test optw transport/mux options", t, func() {
+		l := NewListener("127.0.0.1:2014")
+		l.SetOptions(optw.WithHandshakeTimeout(time.Millisecond * 200))
+		l.SetAccessToken("test auth")
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		convey.Convey("test local address and keepalive", func() {
+			d := NewDialer("127.0.0.1:2014")
+			d.SetAccessToken("test auth")
+			d.SetOptions(
+				optw.WithDialTimeout(time.Second),
+				optw.WithLocalAddr("127.0.0.1"),
+				optw.WithKeepAlive(time.Millisecond*100, time.Millisecond*500),
+			)
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			convey.So(sconn.RemoteAddr().String(), convey.ShouldEqual, conn.LocalAddr().String())
+
+			// keepalive timeout shorter than the interval
+			d.SetOptions(optw.WithKeepAlive(time.Second, time.Millisecond))
+			_, err = d.Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test handshake timeout", func() {
+			silent, err := net.Dial("tcp", "127.0.0.1:2014")
+			convey.So(err, convey.ShouldBeNil)
+			defer silent.Close()
+
+			begin := time.Now()
+			_, err = l.Accept()
+			convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second)
+		})
+
+		convey.Convey("test local address on unix socket", func() {
+			d := NewDialer("unix://" + filepath.Join(t.TempDir(), "optw.sock"))
+			d.SetOptions(optw.WithLocalAddr("127.0.0.1"))
+			_, err := d.Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMuxProxy(t *testing.T) {
+	convey.Convey("test optw transport/mux through a http proxy", t, func() {
+		l := NewListener("127.0.0.1:2015")
+		l.SetAccessToken("test auth")
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		proxy, err := net.Listen("tcp", "127.0.0.1:0")
+		convey.So(err, convey.ShouldBeNil)
+		defer proxy.Close()
+		go http.Serve(proxy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			target, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer target.Close()
+			w.WriteHeader(http.StatusOK)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}))
+
+		convey.Convey("test dial through the proxy", func() {
+			cfg := defaultConfig
+			cfg.Proxy = "http://user:pass@" + proxy.Addr().String()
+			d := NewDialerWithConfig("127.0.0.1:2015", cfg)
+			d.SetAccessToken("test auth")
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+		})
+
+		convey.Convey("test proxy auth fail", func() {
+			cfg := defaultConfig
+			cfg.Proxy = "http://user:invalid@" + proxy.Addr().String()
+			d := NewDialerWithConfig("127.0.0.1:2015", cfg)
+			d.SetAccessToken("test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrProxyAuth), convey.ShouldBeTrue)
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeFalse)
+		})
+
+		convey.Convey("test proxy on unix socket", func() {
+			cfg := defaultConfig
+			cfg.Proxy = "http://" + proxy.Addr().String()
+			_, err := NewDialerWithConfig("unix:///tmp/optw-proxy.sock", cfg).Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
 	})
 }
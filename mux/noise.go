@@ -0,0 +1,36 @@
+package mux
+
+import (
+	"github.com/ICKelin/optw"
+	"net"
+	"time"
+)
+
+// NoisePublicKey returns the hex noise static public key
+// of a listening listener, empty without noise
+func (l *Listener) NoisePublicKey() string {
+	if l.noise == nil {
+		return ""
+	}
+	return l.noise.PublicKey()
+}
+
+// noiseHandshake runs the noise handshake over conn in place of
+// the token handshake, conn is closed on failure
+func (d *Dialer) noiseHandshake(conn net.Conn) (net.Conn, error) {
+	noise, err := d.config.NoiseHandshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	deadline := time.Now().Add(d.config.Timeout())
+	conn.SetDeadline(deadline)
+	noiseConn, err := noise.Client(conn, d.accessToken, d.metadata)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, optw.HandshakeError(err, deadline)
+	}
+	return noiseConn, nil
+}
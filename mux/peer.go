@@ -0,0 +1,45 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"io"
+	"net"
+	"time"
+)
+
+// peerConn is the conn of a client authenticated by its peer identity,
+// eg: its tls client certificate or unix peer credentials.
+// a client which sends its access token anyway starts with the auth
+// header, whose first byte is zero unlike the smux version of a frame,
+// its auth request is rejected instead of being fed to smux.
+type peerConn struct {
+	net.Conn
+	info    *optw.AuthInfo
+	timeout time.Duration
+	checked bool
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.checked || n <= 0 {
+		return n, err
+	}
+	c.checked = true
+	if b[0] != 0 {
+		return n, err
+	}
+
+	// the empty server auth has no secret nor token, it answers
+	// the auth request with a failure the client understands
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{io.MultiReader(bytes.NewReader(append([]byte(nil), b[:n]...)), c.Conn), c.Conn}
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	optw.VerifyAuth(rw, &optw.ServerAuth{}, c.info)
+	c.Conn.Close()
+	return 0, fmt.Errorf("%w: unexpected auth request, the client is authenticated by its peer identity",
+		optw.ErrAuthFailed)
+}
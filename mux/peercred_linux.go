@@ -0,0 +1,33 @@
+//go:build linux
+
+package mux
+
+import (
+	"github.com/ICKelin/optw"
+	"net"
+	"syscall"
+)
+
+// peerCred returns the SO_PEERCRED credentials of a unix socket peer,
+// nil on other connections
+func peerCred(conn net.Conn) *optw.PeerCred {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return nil
+	}
+	return &optw.PeerCred{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}
+}
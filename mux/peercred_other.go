@@ -0,0 +1,13 @@
+//go:build !linux
+
+package mux
+
+import (
+	"github.com/ICKelin/optw"
+	"net"
+)
+
+// peerCred is not supported without SO_PEERCRED
+func peerCred(conn net.Conn) *optw.PeerCred {
+	return nil
+}
@@ -0,0 +1,60 @@
+package mux
+
+import (
+	"crypto/tls"
+	"github.com/ICKelin/optw"
+	"net"
+	"time"
+)
+
+// SetTLSConfig sets the tls config used instead of the one built
+// from the certificate files, it takes effect on Listen
+func (l *Listener) SetTLSConfig(conf *tls.Config) {
+	l.tlsConfig = conf
+}
+
+// SetTLSConfig sets the tls config used instead of the one built
+// from the CA file and server name
+func (d *Dialer) SetTLSConfig(conf *tls.Config) {
+	d.tlsConfig = conf
+}
+
+// clientTLS runs the tls handshake over conn, conn is closed on failure
+func (d *Dialer) clientTLS(conn net.Conn) (net.Conn, error) {
+	conf, err := d.config.tlsConfig(d.tlsConfig, d.remote)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, conf)
+	deadline := time.Now().Add(d.config.Timeout())
+	tlsConn.SetDeadline(deadline)
+	err = tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		tlsConn.Close()
+		return nil, optw.HandshakeError(err, deadline)
+	}
+	return tlsConn, nil
+}
+
+// acceptTLS runs the tls handshake over conn and fills info
+// with the verified client certificate, conn is closed on failure
+func (l *Listener) acceptTLS(conn net.Conn, info *optw.AuthInfo) (net.Conn, error) {
+	tlsConn := tls.Server(conn, l.serverTLS)
+	deadline := time.Now().Add(l.config.Timeout())
+	tlsConn.SetDeadline(deadline)
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		tlsConn.Close()
+		return nil, optw.HandshakeError(err, deadline)
+	}
+
+	info.Certificate = optw.PeerCertificate(tlsConn.ConnectionState())
+	if info.Certificate != nil {
+		info.Identity = optw.CertIdentity(info.Certificate)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,114 @@
+package mux
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixPrefix marks unix socket addresses, eg: unix:///run/optw.sock
+const unixPrefix = "unix://"
+
+// splitNetwork returns the network and address of addr,
+// tcp unless addr has the unix prefix
+func splitNetwork(addr string) (string, string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return "tcp", addr
+}
+
+// listenUnix listens on the socket file path with the octal file mode,
+// a stale socket file left by a dead listener is removed first.
+// With a mode the socket is created in a private directory and moved
+// to path once its mode is set, so it is never reachable with the umask one.
+// The socket file is removed on Close.
+func listenUnix(path, mode string) (net.Listener, error) {
+	var perm os.FileMode
+	if len(mode) > 0 {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket mode %s: %w", mode, err)
+		}
+		perm = os.FileMode(m)
+	}
+
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mode) <= 0 {
+		return net.Listen("unix", path)
+	}
+
+	// the directory is created 0700
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".optw")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmp, perm)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: listener, path: path}, nil
+}
+
+// unixListener is a listener whose socket file was moved to path
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close removes the socket file on the first close only,
+// path may belong to a new listener then
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	if err == nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// removeStaleSocket removes the socket file path if no listener answers on it
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,481 @@
+package optw
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+// noise handshake, it runs in place of the token handshake.
+// The client picks the pattern, IK when it knows the server static key,
+// XX otherwise. The pattern byte is part of the prologue:
+//
+//	client:        | pattern 1 | length 2 | message |
+//	then each way: | length 2 | message |
+//
+// the client payload is sent in the last client message:
+//
+//	| token length 2 | token | metadata |
+//
+// after the handshake the server sends the auth status in the first
+// transport message, then both sides send transport messages.
+// The client static public key is the identity passed to the auth handler.
+const (
+	noisePatternXX = 1
+	noisePatternIK = 2
+
+	noiseMaxMessage = math.MaxUint16
+	noiseMaxPayload = noiseMaxMessage - 16
+)
+
+var (
+	noisePrologue    = []byte("optw noise")
+	noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+)
+
+// NoiseConfig is embedded in the configs of the transports
+// supporting the noise handshake
+type NoiseConfig struct {
+	// run the noise handshake in place of the token handshake
+	Noise bool `json:"noise"`
+	// hex private key file of the static key, an ephemeral key without it
+	NoiseKeyFile string `json:"noiseKeyFile"`
+	// generate a key into NoiseKeyFile if it does not exist
+	GenerateNoiseKey bool `json:"generateNoiseKey"`
+	// hex public key of the server static key, with it the dialer
+	// runs the IK pattern and verifies the server.
+	// Without it the dialer runs the XX pattern, only if NoiseAllowAnyServer is set.
+	NoiseServerKey string `json:"noiseServerKey"`
+	// let the dialer trust any server static key
+	NoiseAllowAnyServer bool `json:"noiseAllowAnyServer"`
+	// hex public keys of the clients the listener accepts
+	NoiseClientKeys []string `json:"noiseClientKeys"`
+	// let a listener without access token, auth handler
+	// or client keys accept any client key
+	NoiseAllowAnyClient bool `json:"noiseAllowAnyClient"`
+}
+
+var (
+	errNoiseAnyServer = fmt.Errorf("noise: no server key to verify the server, " +
+		"set noiseServerKey or noiseAllowAnyServer")
+	errNoiseAnyClient = fmt.Errorf("noise: no access token, auth handler or client keys " +
+		"to verify the clients, set one of them or noiseAllowAnyClient")
+)
+
+// NoiseHandshake runs the noise handshake with the loaded static key
+type NoiseHandshake struct {
+	key            noise.DHKey
+	serverKey      []byte
+	allowAnyServer bool
+	clientKeys     map[string]bool
+	allowAnyClient bool
+}
+
+// NoiseHandshake loads the static key and the server key of the config
+func (c NoiseConfig) NoiseHandshake() (*NoiseHandshake, error) {
+	key, err := c.staticKey()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &NoiseHandshake{
+		key:            key,
+		allowAnyServer: c.NoiseAllowAnyServer,
+		allowAnyClient: c.NoiseAllowAnyClient,
+	}
+	if len(c.NoiseServerKey) > 0 {
+		h.serverKey, err = hex.DecodeString(c.NoiseServerKey)
+		if err != nil || len(h.serverKey) != 32 {
+			return nil, fmt.Errorf("invalid noise server key %s", c.NoiseServerKey)
+		}
+	}
+
+	if len(c.NoiseClientKeys) > 0 {
+		h.clientKeys = make(map[string]bool)
+		for _, clientKey := range c.NoiseClientKeys {
+			public, err := hex.DecodeString(strings.TrimSpace(clientKey))
+			if err != nil || len(public) != 32 {
+				return nil, fmt.Errorf("invalid noise client key %s", clientKey)
+			}
+			h.clientKeys[hex.EncodeToString(public)] = true
+		}
+	}
+	return h, nil
+}
+
+// CheckServer returns an error if a listener with auth
+// would accept any client key
+func (h *NoiseHandshake) CheckServer(auth *ServerAuth) error {
+	if auth.Enabled() || h.clientKeys != nil || h.allowAnyClient {
+		return nil
+	}
+	return errNoiseAnyClient
+}
+
+func (c NoiseConfig) staticKey() (noise.DHKey, error) {
+	if len(c.NoiseKeyFile) <= 0 {
+		return noise.DH25519.GenerateKeypair(rand.Reader)
+	}
+
+	if c.GenerateNoiseKey {
+		_, err := os.Stat(c.NoiseKeyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			err = GenerateNoiseKey(c.NoiseKeyFile)
+		}
+		if err != nil {
+			return noise.DHKey{}, err
+		}
+	}
+	return LoadNoiseKey(c.NoiseKeyFile)
+}
+
+// PublicKey returns the hex public key of the static key
+func (h *NoiseHandshake) PublicKey() string {
+	return hex.EncodeToString(h.key.Public)
+}
+
+// GenerateNoiseKey writes a new hex private key to file
+func GenerateNoiseKey(file string) error {
+	key, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(hex.EncodeToString(key.Private)+"\n"), 0600)
+}
+
+// LoadNoiseKey loads the hex private key file
+func LoadNoiseKey(file string) (noise.DHKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+
+	private, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(private) != 32 {
+		return noise.DHKey{}, fmt.Errorf("invalid noise key file %s", file)
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	return noise.DHKey{Private: private, Public: public}, nil
+}
+
+// Client runs the client side of the handshake and returns the
+// encrypted connection, md is sent to the server, it may be nil.
+// The caller sets the handshake deadline.
+func (h *NoiseHandshake) Client(conn net.Conn, token string, md map[string]string) (net.Conn, error) {
+	metadata, err := encodeMetadata(md)
+	if err != nil {
+		return nil, err
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(token)))
+	payload = append(payload, token...)
+	payload = append(payload, metadata...)
+
+	pattern := byte(noisePatternXX)
+	if h.serverKey != nil {
+		pattern = noisePatternIK
+	} else if !h.allowAnyServer {
+		return nil, errNoiseAnyServer
+	}
+
+	hs, err := h.state(pattern, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var send, recv *noise.CipherState
+	if pattern == noisePatternIK {
+		msg, _, _, err := hs.WriteMessage(nil, payload)
+		if err != nil {
+			return nil, err
+		}
+		err = writeNoiseMessage(conn, append([]byte{pattern}, noiseFrame(msg)...))
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err = readNoiseMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		_, send, recv, err = hs.ReadMessage(nil, msg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: verify server key fail: %v", ErrAuthFailed, err)
+		}
+	} else {
+		msg, _, _, err := hs.WriteMessage(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = writeNoiseMessage(conn, append([]byte{pattern}, noiseFrame(msg)...))
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err = readNoiseMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		_, _, _, err = hs.ReadMessage(nil, msg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: read server message fail: %v", ErrAuthFailed, err)
+		}
+
+		msg, send, recv, err = hs.WriteMessage(nil, payload)
+		if err != nil {
+			return nil, err
+		}
+		err = writeNoiseMessage(conn, noiseFrame(msg))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := newNoiseConn(conn, send, recv)
+	status := make([]byte, 1)
+	_, err = io.ReadFull(c, status)
+	if err != nil {
+		return nil, fmt.Errorf("read auth status fail: %w", err)
+	}
+	if status[0] != authOK {
+		return nil, fmt.Errorf("%w: rejected by server", ErrAuthFailed)
+	}
+	return c, nil
+}
+
+// Server runs the server side of the handshake, the client is verified
+// by its key if client keys are configured, by its token if auth has one
+// and by the auth handler.
+// It returns the encrypted connection and the client identity.
+// The caller sets the handshake deadline.
+func (h *NoiseHandshake) Server(conn net.Conn, auth *ServerAuth, info *AuthInfo) (net.Conn, interface{}, error) {
+	err := h.CheckServer(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pattern := make([]byte, 1)
+	_, err = io.ReadFull(conn, pattern)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read noise pattern fail: %w", err)
+	}
+	if pattern[0] != noisePatternXX && pattern[0] != noisePatternIK {
+		return nil, nil, fmt.Errorf("%w: unknown noise pattern %d", ErrAuthFailed, pattern[0])
+	}
+
+	hs, err := h.state(pattern[0], false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := readNoiseMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, _, _, err := hs.ReadMessage(nil, msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: read client message fail: %v", ErrAuthFailed, err)
+	}
+
+	var send, recv *noise.CipherState
+	if pattern[0] == noisePatternIK {
+		msg, recv, send, err = hs.WriteMessage(nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = writeNoiseMessage(conn, noiseFrame(msg))
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		msg, _, _, err = hs.WriteMessage(nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = writeNoiseMessage(conn, noiseFrame(msg))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		msg, err = readNoiseMessage(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, recv, send, err = hs.ReadMessage(nil, msg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: read client message fail: %v", ErrAuthFailed, err)
+		}
+	}
+
+	c := newNoiseConn(conn, send, recv)
+	identity, err := h.verifyPayload(auth, info, hs.PeerStatic(), payload)
+	status := []byte{authOK}
+	if err != nil {
+		status[0] = authFail
+	}
+
+	_, werr := c.Write(status)
+	if err != nil {
+		return nil, nil, err
+	}
+	if werr != nil {
+		return nil, nil, fmt.Errorf("write auth status fail: %w", werr)
+	}
+	return c, identity, nil
+}
+
+func (h *NoiseHandshake) verifyPayload(auth *ServerAuth, info *AuthInfo, peerStatic, payload []byte) (interface{}, error) {
+	if h.clientKeys != nil && !h.clientKeys[hex.EncodeToString(peerStatic)] {
+		return nil, fmt.Errorf("%w: unknown client key %x", ErrAuthFailed, peerStatic)
+	}
+
+	if len(payload) < 2 || len(payload) < 2+int(binary.BigEndian.Uint16(payload)) {
+		return nil, fmt.Errorf("%w: invalid noise payload", ErrAuthFailed)
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	token := string(payload[2 : 2+n])
+
+	md, err := decodeMetadata(payload[2+n:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+
+	if auth.TokenEnabled() && !auth.checkToken(token, md) {
+		return nil, fmt.Errorf("%w: verify token fail", ErrAuthFailed)
+	}
+
+	info.Token = token
+	info.KeyID = md[MetadataKeyID]
+	info.Metadata = md
+	info.Identity = hex.EncodeToString(peerStatic)
+	return auth.authenticate(info)
+}
+
+func (h *NoiseHandshake) state(pattern byte, initiator bool) (*noise.HandshakeState, error) {
+	conf := noise.Config{
+		CipherSuite:   noiseCipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		Initiator:     initiator,
+		Prologue:      append(append([]byte(nil), noisePrologue...), pattern),
+		StaticKeypair: h.key,
+	}
+	if pattern == noisePatternIK {
+		conf.Pattern = noise.HandshakeIK
+		if initiator {
+			conf.PeerStatic = h.serverKey
+		}
+	}
+	return noise.NewHandshakeState(conf)
+}
+
+func noiseFrame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
+
+func writeNoiseMessage(conn io.Writer, buf []byte) error {
+	_, err := conn.Write(buf)
+	if err != nil {
+		return fmt.Errorf("write noise message fail: %w", err)
+	}
+	return nil
+}
+
+func readNoiseMessage(conn io.Reader) ([]byte, error) {
+	hdr := make([]byte, 2)
+	_, err := io.ReadFull(conn, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("read noise message fail: %w", err)
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(hdr))
+	_, err = io.ReadFull(conn, msg)
+	if err != nil {
+		return nil, fmt.Errorf("read noise message fail: %w", err)
+	}
+	return msg, nil
+}
+
+// noiseConn encrypts each write into noise transport messages
+type noiseConn struct {
+	net.Conn
+	send *noise.CipherState
+	recv *noise.CipherState
+
+	wmu     sync.Mutex
+	rmu     sync.Mutex
+	rbuf    []byte
+	recvErr error
+}
+
+func newNoiseConn(conn net.Conn, send, recv *noise.CipherState) *noiseConn {
+	return &noiseConn{Conn: conn, send: send, recv: recv}
+}
+
+func (c *noiseConn) Read(buf []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rbuf) <= 0 {
+		if c.recvErr != nil {
+			return 0, c.recvErr
+		}
+
+		msg, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+
+		c.rbuf, err = c.recv.Decrypt(msg[:0], nil, msg)
+		if err != nil {
+			c.recvErr = fmt.Errorf("%w: %v", ErrFrameAuth, err)
+			c.Conn.Close()
+			return 0, c.recvErr
+		}
+	}
+
+	n := copy(buf, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(buf []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var out bytes.Buffer
+	for data := buf; len(data) > 0; {
+		n := len(data)
+		if n > noiseMaxPayload {
+			n = noiseMaxPayload
+		}
+
+		msg, err := c.send.Encrypt(nil, nil, data[:n])
+		if err != nil {
+			return 0, err
+		}
+		out.Write(noiseFrame(msg))
+		data = data[n:]
+	}
+
+	_, err := c.Conn.Write(out.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
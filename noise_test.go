@@ -0,0 +1,174 @@
+package optw
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type noiseResult struct {
+	conn     net.Conn
+	identity interface{}
+	err      error
+}
+
+// noisePair runs the noise handshake over a pipe
+func noisePair(client, server *NoiseHandshake, auth *ServerAuth, token string) (net.Conn, noiseResult, error) {
+	cconn, sconn := net.Pipe()
+	deadline := time.Now().Add(time.Second)
+	cconn.SetDeadline(deadline)
+	sconn.SetDeadline(deadline)
+
+	accepted := make(chan noiseResult, 1)
+	go func() {
+		info := &AuthInfo{RemoteAddr: sconn.RemoteAddr(), Scheme: "test"}
+		conn, identity, err := server.Server(sconn, auth, info)
+		if err != nil {
+			sconn.Close()
+		}
+		accepted <- noiseResult{conn, identity, err}
+	}()
+
+	conn, err := client.Client(cconn, token, map[string]string{"clientId": "client-1"})
+	if err != nil {
+		cconn.Close()
+	}
+	res := <-accepted
+	cconn.SetDeadline(time.Time{})
+	sconn.SetDeadline(time.Time{})
+	return conn, res, err
+}
+
+func TestNoise(t *testing.T) {
+	convey.Convey("test noise handshake", t, func() {
+		dir := t.TempDir()
+		server, err := NoiseConfig{
+			NoiseKeyFile:     filepath.Join(dir, "server.key"),
+			GenerateNoiseKey: true,
+		}.NoiseHandshake()
+		convey.So(err, convey.ShouldBeNil)
+
+		client, err := NoiseConfig{NoiseAllowAnyServer: true}.NoiseHandshake()
+		convey.So(err, convey.ShouldBeNil)
+
+		auth := &ServerAuth{}
+		auth.SetAccessToken("test auth")
+		auth.SetAuthHandler(func(info *AuthInfo) (interface{}, error) {
+			if info.Metadata["clientId"] != "client-1" {
+				return nil, fmt.Errorf("unknown client")
+			}
+			return info.Identity, nil
+		})
+
+		convey.Convey("test key file", func() {
+			loaded, err := NoiseConfig{NoiseKeyFile: filepath.Join(dir, "server.key")}.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(loaded.PublicKey(), convey.ShouldEqual, server.PublicKey())
+
+			_, err = NoiseConfig{NoiseKeyFile: filepath.Join(dir, "missing.key")}.NoiseHandshake()
+			convey.So(err, convey.ShouldNotBeNil)
+			_, err = NoiseConfig{NoiseServerKey: "abcd"}.NoiseHandshake()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test XX pattern", func() {
+			conn, res, err := noisePair(client, server, auth, "test auth")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(res.err, convey.ShouldBeNil)
+			convey.So(res.identity, convey.ShouldEqual, client.PublicKey())
+
+			go conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(res.conn, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+		})
+
+		convey.Convey("test IK pattern", func() {
+			ik, err := NoiseConfig{NoiseServerKey: server.PublicKey()}.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			conn, res, err := noisePair(ik, server, auth, "test auth")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(res.err, convey.ShouldBeNil)
+			convey.So(res.identity, convey.ShouldEqual, ik.PublicKey())
+
+			go res.conn.Write([]byte("pong"))
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(conn, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "pong")
+		})
+
+		convey.Convey("test IK pattern with another server key", func() {
+			ik, err := NoiseConfig{NoiseServerKey: client.PublicKey()}.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			_, res, err := noisePair(ik, server, auth, "test auth")
+			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(errors.Is(res.err, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test wrong token", func() {
+			_, res, err := noisePair(client, server, auth, "invalid test auth")
+			convey.So(errors.Is(err, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(res.err, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test key identity without token", func() {
+			keyOnly := &ServerAuth{}
+			keyOnly.SetAuthHandler(func(info *AuthInfo) (interface{}, error) {
+				if info.Identity != client.PublicKey() {
+					return nil, fmt.Errorf("unknown key %s", info.Identity)
+				}
+				return "client-1", nil
+			})
+			_, res, err := noisePair(client, server, keyOnly, "")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(res.identity, convey.ShouldEqual, "client-1")
+
+			other, err := NoiseConfig{NoiseAllowAnyServer: true}.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			_, res, err = noisePair(other, server, keyOnly, "")
+			convey.So(errors.Is(err, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(res.err, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test XX pattern requires allow any server", func() {
+			xx, err := NoiseConfig{}.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			_, err = xx.Client(nil, "test auth", nil)
+			convey.So(err, convey.ShouldEqual, errNoiseAnyServer)
+		})
+
+		convey.Convey("test client keys", func() {
+			noAuth := &ServerAuth{}
+			convey.So(server.CheckServer(noAuth), convey.ShouldEqual, errNoiseAnyClient)
+			anyClient, err := NoiseConfig{NoiseAllowAnyClient: true}.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(anyClient.CheckServer(noAuth), convey.ShouldBeNil)
+
+			_, err = NoiseConfig{NoiseClientKeys: []string{"abcd"}}.NoiseHandshake()
+			convey.So(err, convey.ShouldNotBeNil)
+			allowed, err := NoiseConfig{
+				NoiseKeyFile:    filepath.Join(dir, "server.key"),
+				NoiseClientKeys: []string{client.PublicKey()},
+			}.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(allowed.CheckServer(noAuth), convey.ShouldBeNil)
+
+			_, res, err := noisePair(client, allowed, noAuth, "")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(res.identity, convey.ShouldEqual, client.PublicKey())
+
+			other, err := NoiseConfig{NoiseAllowAnyServer: true}.NoiseHandshake()
+			convey.So(err, convey.ShouldBeNil)
+			_, res, err = noisePair(other, allowed, noAuth, "")
+			convey.So(errors.Is(err, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(res.err, ErrAuthFailed), convey.ShouldBeTrue)
+		})
+	})
+}
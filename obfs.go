@@ -0,0 +1,335 @@
+package optw
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// obfuscation layer, it hides the framing of the transport inside,
+// eg: smux headers, from dpi boxes. It is not an encryption, the frames
+// are not authenticated, use tls or a psk transport for confidentiality.
+//
+// the client speaks first, every byte after the nonces is scrambled by
+// chacha20 with a key derived from the shared key and the nonces:
+//
+//	client hello: | nonce 16 | timestamp 8 | padding length 2 | padding | hmac 16 |
+//	server hello: | nonce 16 | padding length 2 | padding |
+//	frame:        | data length 2 | padding length 1 | data | padding |
+//
+// the server stays silent to a hello without a valid hmac, a stale
+// timestamp or a replayed nonce, it reads until the client or the
+// handshake deadline gives up as an unused tcp port would.
+const (
+	obfsNonceSize   = 16
+	obfsMacSize     = 16
+	obfsMaxPadding  = 512
+	obfsMaxFrame    = 16 * 1024
+	obfsFramePad    = 255
+	obfsClockSkew   = time.Minute * 2
+	obfsFrameHeader = 3
+)
+
+var (
+	obfsHelloLabel = []byte("optw obfs hello")
+	obfsC2SLabel   = []byte("optw obfs c2s")
+	obfsS2CLabel   = []byte("optw obfs s2c")
+
+	errObfsHello = fmt.Errorf("%w: invalid obfuscated hello", ErrAuthFailed)
+
+	obfsReplay = &replayCache{nonces: make(map[[obfsNonceSize]byte]bool)}
+)
+
+// ObfsConfig is embedded in the configs of the stream transports
+type ObfsConfig struct {
+	// shared key of the obfuscation layer, empty disables it
+	ObfsKey string `json:"obfsKey"`
+}
+
+// ObfsEnabled reports whether the obfuscation layer is enabled
+func (c ObfsConfig) ObfsEnabled() bool {
+	return len(c.ObfsKey) > 0
+}
+
+// ObfsClient runs the client side obfuscation handshake over conn
+// and returns the scrambled connection.
+// The caller sets the handshake deadline.
+func (c ObfsConfig) ObfsClient(conn net.Conn) (net.Conn, error) {
+	key := obfsKey(c.ObfsKey)
+	clientNonce := make([]byte, obfsNonceSize)
+	_, err := rand.Read(clientNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := randomPadding(obfsMaxPadding)
+	hello := make([]byte, 0, obfsNonceSize+10+len(padding)+obfsMacSize)
+	hello = append(hello, clientNonce...)
+	hello = binary.BigEndian.AppendUint64(hello, uint64(time.Now().Unix()))
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(padding)))
+	hello = append(hello, padding...)
+	hello = append(hello, obfsMac(key, hello)...)
+
+	enc := newObfsCipher(key, obfsC2SLabel, clientNonce)
+	enc.XORKeyStream(hello[obfsNonceSize:], hello[obfsNonceSize:])
+	_, err = conn.Write(hello)
+	if err != nil {
+		return nil, fmt.Errorf("write obfs hello fail: %w", err)
+	}
+
+	serverNonce := make([]byte, obfsNonceSize)
+	_, err = io.ReadFull(conn, serverNonce)
+	if err != nil {
+		return nil, fmt.Errorf("read obfs hello fail: %w", err)
+	}
+
+	dec := newObfsCipher(key, obfsS2CLabel, clientNonce, serverNonce)
+	err = skipPadding(conn, dec)
+	if err != nil {
+		return nil, fmt.Errorf("read obfs hello fail: %w", err)
+	}
+	return &obfsConn{Conn: conn, enc: enc, dec: dec}, nil
+}
+
+// ObfsServer runs the server side obfuscation handshake over conn
+// and returns the scrambled connection, an invalid client is read
+// silently until it closes or the deadline set by the caller passes.
+func (c ObfsConfig) ObfsServer(conn net.Conn) (net.Conn, error) {
+	key := obfsKey(c.ObfsKey)
+	hdr := make([]byte, obfsNonceSize+10)
+	_, err := io.ReadFull(conn, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("read obfs hello fail: %w", err)
+	}
+
+	clientNonce := hdr[:obfsNonceSize]
+	dec := newObfsCipher(key, obfsC2SLabel, clientNonce)
+	dec.XORKeyStream(hdr[obfsNonceSize:], hdr[obfsNonceSize:])
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(hdr[obfsNonceSize:])), 0)
+	padLen := int(binary.BigEndian.Uint16(hdr[obfsNonceSize+8:]))
+	if padLen > obfsMaxPadding {
+		return nil, silent(conn)
+	}
+
+	rest := make([]byte, padLen+obfsMacSize)
+	_, err = io.ReadFull(conn, rest)
+	if err != nil {
+		return nil, fmt.Errorf("read obfs hello fail: %w", err)
+	}
+	dec.XORKeyStream(rest, rest)
+
+	hello := append(hdr, rest[:padLen]...)
+	if !hmac.Equal(rest[padLen:], obfsMac(key, hello)) {
+		return nil, silent(conn)
+	}
+
+	skew := time.Since(timestamp)
+	if skew > obfsClockSkew || skew < -obfsClockSkew || !obfsReplay.add(clientNonce) {
+		return nil, silent(conn)
+	}
+
+	serverNonce := make([]byte, obfsNonceSize)
+	_, err = rand.Read(serverNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := randomPadding(obfsMaxPadding)
+	reply := make([]byte, 0, obfsNonceSize+2+len(padding))
+	reply = append(reply, serverNonce...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(len(padding)))
+	reply = append(reply, padding...)
+
+	enc := newObfsCipher(key, obfsS2CLabel, clientNonce, serverNonce)
+	enc.XORKeyStream(reply[obfsNonceSize:], reply[obfsNonceSize:])
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, fmt.Errorf("write obfs hello fail: %w", err)
+	}
+	return &obfsConn{Conn: conn, enc: enc, dec: dec}, nil
+}
+
+// silent reads conn until the client gives up or the deadline passes
+func silent(conn net.Conn) error {
+	io.Copy(io.Discard, conn)
+	return errObfsHello
+}
+
+func skipPadding(conn net.Conn, dec *chacha20.Cipher) error {
+	hdr := make([]byte, 2)
+	_, err := io.ReadFull(conn, hdr)
+	if err != nil {
+		return err
+	}
+	dec.XORKeyStream(hdr, hdr)
+
+	padLen := int(binary.BigEndian.Uint16(hdr))
+	if padLen > obfsMaxPadding {
+		return fmt.Errorf("invalid padding length %d", padLen)
+	}
+	padding := make([]byte, padLen)
+	_, err = io.ReadFull(conn, padding)
+	if err != nil {
+		return err
+	}
+	dec.XORKeyStream(padding, padding)
+	return nil
+}
+
+func obfsKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+func obfsMac(key, hello []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(obfsHelloLabel)
+	mac.Write(hello)
+	return mac.Sum(nil)[:obfsMacSize]
+}
+
+// newObfsCipher returns the keystream of one direction,
+// its key is derived from the shared key, the label and the nonces
+func newObfsCipher(key, label []byte, nonces ...[]byte) *chacha20.Cipher {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(label)
+	for _, nonce := range nonces {
+		mac.Write(nonce)
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(mac.Sum(nil), make([]byte, chacha20.NonceSize))
+	if err != nil {
+		// the key and nonce sizes are fixed
+		panic(err)
+	}
+	return cipher
+}
+
+// randomPadding returns up to max zero bytes, the keystream scrambles them
+func randomPadding(max int) []byte {
+	return make([]byte, mrand.Intn(max+1))
+}
+
+// obfsConn scrambles the frames of conn,
+// each write is split into frames with random padding.
+type obfsConn struct {
+	net.Conn
+	enc *chacha20.Cipher
+	dec *chacha20.Cipher
+
+	wmu  sync.Mutex
+	rmu  sync.Mutex
+	rbuf []byte
+}
+
+func (c *obfsConn) Read(buf []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rbuf) <= 0 {
+		err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(buf, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *obfsConn) readFrame() error {
+	hdr := make([]byte, obfsFrameHeader)
+	_, err := io.ReadFull(c.Conn, hdr)
+	if err != nil {
+		return err
+	}
+	c.dec.XORKeyStream(hdr, hdr)
+
+	dataLen := int(binary.BigEndian.Uint16(hdr))
+	if dataLen > obfsMaxFrame {
+		return fmt.Errorf("invalid obfs frame length %d", dataLen)
+	}
+
+	body := make([]byte, dataLen+int(hdr[2]))
+	_, err = io.ReadFull(c.Conn, body)
+	if err != nil {
+		return err
+	}
+	c.dec.XORKeyStream(body, body)
+	c.rbuf = body[:dataLen]
+	return nil
+}
+
+func (c *obfsConn) Write(buf []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	out := make([]byte, 0, len(buf)+(len(buf)/obfsMaxFrame+1)*(obfsFrameHeader+obfsFramePad))
+	for data := buf; len(data) > 0; {
+		n := len(data)
+		if n > obfsMaxFrame {
+			n = obfsMaxFrame
+		}
+
+		padding := randomPadding(obfsFramePad)
+		start := len(out)
+		out = binary.BigEndian.AppendUint16(out, uint16(n))
+		out = append(out, byte(len(padding)))
+		out = append(out, data[:n]...)
+		out = append(out, padding...)
+		c.enc.XORKeyStream(out[start:], out[start:])
+		data = data[n:]
+	}
+
+	_, err := c.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// replayCache remembers the hello nonces within the clock skew,
+// the nonces all live as long so the queue is in expiry order
+type replayCache struct {
+	mu     sync.Mutex
+	nonces map[[obfsNonceSize]byte]bool
+	queue  []replayEntry
+}
+
+type replayEntry struct {
+	nonce  [obfsNonceSize]byte
+	expire time.Time
+}
+
+// add reports whether nonce is new
+func (r *replayCache) add(nonce []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	expired := 0
+	for expired < len(r.queue) && now.After(r.queue[expired].expire) {
+		delete(r.nonces, r.queue[expired].nonce)
+		expired++
+	}
+	r.queue = r.queue[expired:]
+
+	var key [obfsNonceSize]byte
+	copy(key[:], nonce)
+	if r.nonces[key] {
+		return false
+	}
+	r.nonces[key] = true
+	r.queue = append(r.queue, replayEntry{nonce: key, expire: now.Add(obfsClockSkew * 2)})
+	return true
+}
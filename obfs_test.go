@@ -0,0 +1,124 @@
+package optw
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type obfsResult struct {
+	conn net.Conn
+	err  error
+}
+
+// obfsPair runs the obfuscation handshake over a pipe
+func obfsPair(clientKey, serverKey string) (net.Conn, net.Conn, error, error) {
+	client, server := net.Pipe()
+	deadline := time.Now().Add(time.Millisecond * 200)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+
+	accepted := make(chan obfsResult, 1)
+	go func() {
+		conn, err := ObfsConfig{ObfsKey: serverKey}.ObfsServer(server)
+		accepted <- obfsResult{conn, err}
+	}()
+
+	cconn, cerr := ObfsConfig{ObfsKey: clientKey}.ObfsClient(client)
+	if cerr != nil {
+		client.Close()
+	}
+	res := <-accepted
+	client.SetDeadline(time.Time{})
+	server.SetDeadline(time.Time{})
+	return cconn, res.conn, cerr, res.err
+}
+
+// recordConn records the bytes written to conn
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(buf []byte) (int, error) {
+	c.written.Write(buf)
+	return c.Conn.Write(buf)
+}
+
+func TestObfs(t *testing.T) {
+	convey.Convey("test obfuscation layer", t, func() {
+		convey.Convey("test scrambled stream", func() {
+			client, server, cerr, serr := obfsPair("obfs key", "obfs key")
+			convey.So(cerr, convey.ShouldBeNil)
+			convey.So(serr, convey.ShouldBeNil)
+			defer client.Close()
+
+			payload := bytes.Repeat([]byte("smux"), 10000)
+			go client.Write(payload)
+			buf := make([]byte, len(payload))
+			_, err := io.ReadFull(server, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(buf, convey.ShouldResemble, payload)
+
+			go server.Write([]byte("pong"))
+			_, err = io.ReadFull(client, buf[:4])
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf[:4]), convey.ShouldEqual, "pong")
+		})
+
+		convey.Convey("test no plaintext on the wire", func() {
+			raw, peer := net.Pipe()
+			defer raw.Close()
+			go io.Copy(io.Discard, peer)
+			rec := &recordConn{Conn: raw}
+			conn := &obfsConn{
+				Conn: rec,
+				enc:  newObfsCipher(obfsKey("obfs key"), obfsC2SLabel, make([]byte, obfsNonceSize)),
+			}
+
+			payload := bytes.Repeat([]byte("smux"), 100)
+			conn.Write(payload)
+			conn.Write(payload)
+			convey.So(bytes.Contains(rec.written.Bytes(), []byte("smuxsmux")), convey.ShouldBeFalse)
+			convey.So(rec.written.Len(), convey.ShouldBeGreaterThanOrEqualTo, len(payload)*2+obfsFrameHeader*2)
+		})
+
+		convey.Convey("test silent server without the key", func() {
+			begin := time.Now()
+			_, _, cerr, serr := obfsPair("invalid key", "obfs key")
+			convey.So(IsTimeout(cerr), convey.ShouldBeTrue)
+			convey.So(errors.Is(serr, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(time.Since(begin), convey.ShouldBeGreaterThanOrEqualTo, time.Millisecond*200)
+		})
+
+		convey.Convey("test replayed hello", func() {
+			nonce := make([]byte, obfsNonceSize)
+			rand.Read(nonce)
+			convey.So(obfsReplay.add(nonce), convey.ShouldBeTrue)
+			convey.So(obfsReplay.add(nonce), convey.ShouldBeFalse)
+		})
+
+		convey.Convey("test replay cache expiry", func() {
+			r := &replayCache{nonces: make(map[[obfsNonceSize]byte]bool)}
+			nonces := make([][]byte, 3)
+			for i := range nonces {
+				nonces[i] = make([]byte, obfsNonceSize)
+				rand.Read(nonces[i])
+				convey.So(r.add(nonces[i]), convey.ShouldBeTrue)
+			}
+
+			// the oldest nonces expire first
+			r.queue[0].expire = time.Now().Add(-time.Second)
+			r.queue[1].expire = time.Now().Add(-time.Second)
+			convey.So(r.add(nonces[2]), convey.ShouldBeFalse)
+			convey.So(len(r.nonces), convey.ShouldEqual, 1)
+			convey.So(len(r.queue), convey.ShouldEqual, 1)
+			convey.So(r.add(nonces[0]), convey.ShouldBeTrue)
+		})
+	})
+}
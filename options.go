@@ -0,0 +1,155 @@
+package optw
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Options are the settings shared by the dialers and listeners of all
+// transports, they take precedence over the transport config.
+// Settings which do not apply to a side or a transport are ignored,
+// eg: the local address of a listener or of the mem transport.
+type Options struct {
+	// timeout of establishing the underlying connection,
+	// the tcp connect, the quic handshake or the whole kcp dial
+	DialTimeout time.Duration
+	// local address the dialer binds to, eg: 10.0.0.2 or 10.0.0.2:5000
+	LocalAddr string
+	// keepalive of the session, the peer is considered dead
+	// without any reply in timeout
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	// timeout of each handshake of the connection
+	HandshakeTimeout time.Duration
+	// let the dialer send its token in plaintext to a server which can
+	// not verify the proof, eg: one with an auth func only
+	LegacyAuth bool
+}
+
+// Option sets one of the Options
+type Option func(*Options)
+
+// WithDialTimeout sets the timeout of establishing the underlying connection
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.DialTimeout = timeout
+	}
+}
+
+// WithLocalAddr binds dialers to the local address addr,
+// an ip or an ip:port, to pick the egress interface
+func WithLocalAddr(addr string) Option {
+	return func(o *Options) {
+		o.LocalAddr = addr
+	}
+}
+
+// WithKeepAlive sets the keepalive interval and timeout of the session
+func WithKeepAlive(interval, timeout time.Duration) Option {
+	return func(o *Options) {
+		o.KeepAliveInterval = interval
+		o.KeepAliveTimeout = timeout
+	}
+}
+
+// WithHandshakeTimeout sets the timeout of each handshake
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.HandshakeTimeout = timeout
+	}
+}
+
+// WithLegacyAuth lets the dialer fall back to sending its token in plaintext
+// to a server without secret for it, there is no proof of the server then
+func WithLegacyAuth(enable bool) Option {
+	return func(o *Options) {
+		o.LegacyAuth = enable
+	}
+}
+
+// Apply sets opts in order
+func (o *Options) Apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// Handshake lays the handshake timeout over cfg
+func (o Options) Handshake(cfg HandshakeConfig) HandshakeConfig {
+	if o.HandshakeTimeout > 0 {
+		cfg.timeout = o.HandshakeTimeout
+	}
+	return cfg
+}
+
+// KeepAlive returns the keepalive interval and timeout,
+// the given ones of the transport config for unset options
+func (o Options) KeepAlive(interval, timeout time.Duration) (time.Duration, time.Duration) {
+	if o.KeepAliveInterval > 0 {
+		interval = o.KeepAliveInterval
+	}
+	if o.KeepAliveTimeout > 0 {
+		timeout = o.KeepAliveTimeout
+	}
+	return interval, timeout
+}
+
+// AuthRequest runs the client side of the auth handshake,
+// with the plaintext fallback if legacy auth is enabled
+func (o Options) AuthRequest(conn io.ReadWriter, token string, md map[string]string) error {
+	if o.LegacyAuth {
+		return LegacyAuthRequest(conn, token, md)
+	}
+	return AuthRequest(conn, token, md)
+}
+
+// NetDialer returns a dialer of network with the dial timeout
+// and bound to the local address
+func (o Options) NetDialer(network string) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: o.DialTimeout}
+	if len(o.LocalAddr) <= 0 {
+		return dialer, nil
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		addr, err := net.ResolveTCPAddr(network, o.localHostPort())
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address %s: %w", o.LocalAddr, err)
+		}
+		dialer.LocalAddr = addr
+	case "udp", "udp4", "udp6":
+		addr, err := o.UDPAddr(network)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = addr
+	default:
+		return nil, fmt.Errorf("local address %s is not supported on %s", o.LocalAddr, network)
+	}
+	return dialer, nil
+}
+
+// UDPAddr returns the local address on network udp, nil if unset
+func (o Options) UDPAddr(network string) (*net.UDPAddr, error) {
+	if len(o.LocalAddr) <= 0 {
+		return nil, nil
+	}
+
+	addr, err := net.ResolveUDPAddr(network, o.localHostPort())
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address %s: %w", o.LocalAddr, err)
+	}
+	return addr, nil
+}
+
+// localHostPort returns the local address with port 0 if it has no port
+func (o Options) localHostPort() string {
+	_, _, err := net.SplitHostPort(o.LocalAddr)
+	if err != nil {
+		return net.JoinHostPort(o.LocalAddr, "0")
+	}
+	return o.LocalAddr
+}
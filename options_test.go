@@ -0,0 +1,78 @@
+package optw
+
+import (
+	"github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOptions(t *testing.T) {
+	convey.Convey("test options", t, func() {
+		var opts Options
+		opts.Apply(
+			WithDialTimeout(time.Second),
+			WithLocalAddr("127.0.0.1"),
+			WithKeepAlive(time.Second, time.Second*3),
+			WithHandshakeTimeout(time.Millisecond*500),
+		)
+		convey.So(opts.DialTimeout, convey.ShouldEqual, time.Second)
+
+		convey.Convey("test handshake timeout", func() {
+			cfg := opts.Handshake(DefaultHandshakeConfig)
+			convey.So(cfg.Timeout(), convey.ShouldEqual, time.Millisecond*500)
+			convey.So(cfg.HandshakeTimeout, convey.ShouldEqual, DefaultHandshakeConfig.HandshakeTimeout)
+
+			cfg = Options{}.Handshake(DefaultHandshakeConfig)
+			convey.So(cfg.Timeout(), convey.ShouldEqual, DefaultHandshakeTimeout)
+		})
+
+		convey.Convey("test keepalive", func() {
+			interval, timeout := opts.KeepAlive(time.Second*10, time.Second*30)
+			convey.So(interval, convey.ShouldEqual, time.Second)
+			convey.So(timeout, convey.ShouldEqual, time.Second*3)
+
+			interval, timeout = Options{}.KeepAlive(time.Second*10, time.Second*30)
+			convey.So(interval, convey.ShouldEqual, time.Second*10)
+			convey.So(timeout, convey.ShouldEqual, time.Second*30)
+		})
+
+		convey.Convey("test local address", func() {
+			dialer, err := opts.NetDialer("tcp")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(dialer.Timeout, convey.ShouldEqual, time.Second)
+			convey.So(dialer.LocalAddr.String(), convey.ShouldEqual, "127.0.0.1:0")
+
+			opts.Apply(WithLocalAddr("127.0.0.1:5000"))
+			addr, err := opts.UDPAddr("udp")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(addr.String(), convey.ShouldEqual, "127.0.0.1:5000")
+
+			_, err = opts.NetDialer("unix")
+			convey.So(err, convey.ShouldNotBeNil)
+			_, err = Options{LocalAddr: "invalid:addr:1"}.NetDialer("tcp")
+			convey.So(err, convey.ShouldNotBeNil)
+
+			dialer, err = Options{}.NetDialer("unix")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(dialer.LocalAddr, convey.ShouldBeNil)
+			addr, err = Options{}.UDPAddr("udp")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(addr, convey.ShouldBeNil)
+		})
+
+		convey.Convey("test dial from the local address", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			opts.Apply(WithLocalAddr("127.0.0.1"))
+			dialer, err := opts.NetDialer("tcp")
+			convey.So(err, convey.ShouldBeNil)
+			conn, err := dialer.Dial("tcp", l.Addr().String())
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+			convey.So(conn.LocalAddr().(*net.TCPAddr).IP.String(), convey.ShouldEqual, "127.0.0.1")
+		})
+	})
+}
@@ -0,0 +1,416 @@
+package optw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMinBackoff    = time.Millisecond * 500
+	DefaultMaxBackoff    = time.Second * 30
+	DefaultCheckInterval = time.Second
+)
+
+var errReconnecting = fmt.Errorf("%w: reconnecting", ErrConnClosed)
+
+var _ Conn = &PersistentConn{}
+
+// ConnState is the state of a PersistentConn
+type ConnState int
+
+const (
+	// the connection is up
+	StateConnected ConnState = iota
+	// the connection died, a redial follows
+	StateDisconnected
+	// a dial failed, the next one follows the backoff
+	StateRetrying
+	// a dial failed with a permanent error, the redial stopped
+	StateFailed
+)
+
+// permanentErrors stop the redial, another dial would fail the same way
+var permanentErrors = []error{ErrAuthFailed, ErrFingerprintMismatch, ErrProxyAuth}
+
+func isPermanent(err error) bool {
+	for _, kind := range permanentErrors {
+		if errors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateRetrying:
+		return "retrying"
+	case StateFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+}
+
+type PersistentConfig struct {
+	// backoff between failed dials, it doubles from MinBackoff up to
+	// MaxBackoff and each wait is jittered in [backoff/2, backoff]
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// interval of checking IsClosed of the connection, besides
+	// the stream errors which report a dead connection at once
+	CheckInterval time.Duration
+	// OpenStream and AcceptStream fail with ErrConnClosed while
+	// reconnecting instead of waiting for the redial
+	FailFast bool
+	// OnStateChange is called on every state change from the redial
+	// goroutine, err is the cause of a disconnection or a retry.
+	// It must not block nor call Close.
+	OnStateChange func(state ConnState, err error)
+}
+
+func (c PersistentConfig) minBackoff() time.Duration {
+	if c.MinBackoff <= 0 {
+		return DefaultMinBackoff
+	}
+	return c.MinBackoff
+}
+
+func (c PersistentConfig) maxBackoff() time.Duration {
+	if c.MaxBackoff < c.minBackoff() {
+		return max(DefaultMaxBackoff, c.minBackoff())
+	}
+	return c.MaxBackoff
+}
+
+func (c PersistentConfig) checkInterval() time.Duration {
+	if c.CheckInterval <= 0 {
+		return DefaultCheckInterval
+	}
+	return c.CheckInterval
+}
+
+// PersistentConn is a Conn which redials with dialer once the
+// connection dies, streams of the dead connection fail and new
+// ones go to the redialed connection.
+type PersistentConn struct {
+	dialer Dialer
+	config PersistentConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+	exited chan struct{}
+
+	mu    sync.Mutex
+	state ConnState
+	// conn is the live connection, nil while reconnecting,
+	// ready is closed once it is up and dead once it dies
+	conn     Conn
+	last     Conn
+	ready    chan struct{}
+	dead     chan struct{}
+	cause    error
+	deadline time.Time
+	// err is the permanent dial error which stopped the redial
+	err error
+}
+
+// NewPersistentConn dials with dialer in background,
+// the streams wait for the first connection unless fail fast.
+// A dial failing with ErrAuthFailed, ErrFingerprintMismatch or ErrProxyAuth
+// stops the redial and closes the persistent conn, see Err.
+func NewPersistentConn(dialer Dialer, cfg PersistentConfig) *PersistentConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PersistentConn{
+		dialer: dialer,
+		config: cfg,
+		ctx:    ctx,
+		cancel: cancel,
+		exited: make(chan struct{}),
+		state:  StateDisconnected,
+		ready:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// run dials and redials the connection until Close
+func (p *PersistentConn) run() {
+	defer close(p.exited)
+	backoff := p.config.minBackoff()
+	for {
+		conn, err := p.dialer.DialContext(p.ctx)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			if isPermanent(err) {
+				p.fail(err)
+				return
+			}
+			p.setState(StateRetrying, err)
+			if !p.sleep(jitter(backoff)) {
+				return
+			}
+			backoff = min(backoff*2, p.config.maxBackoff())
+			continue
+		}
+		backoff = p.config.minBackoff()
+
+		dead := p.connected(conn)
+		cause := p.watch(conn, dead)
+		conn.Close()
+		if p.ctx.Err() != nil {
+			return
+		}
+		p.setState(StateDisconnected, cause)
+	}
+}
+
+// watch waits until conn dies or the persistent conn is closed
+func (p *PersistentConn) watch(conn Conn, dead chan struct{}) error {
+	ticker := time.NewTicker(p.config.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if conn.IsClosed() {
+				p.disconnect(conn, ErrConnClosed)
+			}
+		case <-dead:
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return p.cause
+		case <-p.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sleep waits d, it returns false once the persistent conn is closed
+func (p *PersistentConn) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// jitter returns a random duration in [d/2, d]
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(mrand.Int63n(int64(d-half)+1))
+}
+
+func (p *PersistentConn) connected(conn Conn) chan struct{} {
+	p.mu.Lock()
+	p.conn, p.last = conn, conn
+	p.dead = make(chan struct{})
+	p.cause = nil
+	dead := p.dead
+	close(p.ready)
+	p.mu.Unlock()
+
+	p.setState(StateConnected, nil)
+	return dead
+}
+
+// disconnect marks conn as dead so that the streams wait for the redial
+func (p *PersistentConn) disconnect(conn Conn, cause error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != conn {
+		return
+	}
+	p.conn = nil
+	p.cause = cause
+	p.ready = make(chan struct{})
+	close(p.dead)
+}
+
+// fail stops the redial on the permanent dial error err
+func (p *PersistentConn) fail(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+	p.setState(StateFailed, err)
+	p.cancel()
+}
+
+func (p *PersistentConn) setState(state ConnState, err error) {
+	p.mu.Lock()
+	p.state = state
+	p.mu.Unlock()
+	if p.config.OnStateChange != nil {
+		p.config.OnStateChange(state, err)
+	}
+}
+
+// State returns the current state
+func (p *PersistentConn) State() ConnState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// Err returns the permanent dial error which stopped the redial,
+// nil while redialing or after Close
+func (p *PersistentConn) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// current returns the live connection, it waits for the redial
+// unless fail fast
+func (p *PersistentConn) current(ctx context.Context) (Conn, error) {
+	for {
+		if p.IsClosed() {
+			if err := p.Err(); err != nil {
+				return nil, Wrap(ErrConnClosed, err)
+			}
+			return nil, Wrap(ErrConnClosed, net.ErrClosed)
+		}
+
+		p.mu.Lock()
+		conn, ready := p.conn, p.ready
+		p.mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		if p.config.FailFast {
+			return nil, errReconnecting
+		}
+		select {
+		case <-ready:
+		case <-p.ctx.Done():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// do runs op on the live connection, a connection dying under op
+// is reported to the redial and op runs again on the next one
+func (p *PersistentConn) do(ctx context.Context, op func(conn Conn) (Stream, error)) (Stream, error) {
+	for {
+		conn, err := p.current(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := op(conn)
+		if err == nil {
+			return stream, nil
+		}
+		if !errors.Is(err, ErrConnClosed) || ctx.Err() != nil {
+			return nil, err
+		}
+		p.disconnect(conn, err)
+		if p.config.FailFast {
+			return nil, err
+		}
+	}
+}
+
+func (p *PersistentConn) OpenStream() (Stream, error) {
+	return p.OpenStreamContext(context.Background())
+}
+
+// OpenStreamContext opens a stream on the live connection
+func (p *PersistentConn) OpenStreamContext(ctx context.Context) (Stream, error) {
+	return p.do(ctx, func(conn Conn) (Stream, error) {
+		return conn.OpenStreamContext(ctx)
+	})
+}
+
+func (p *PersistentConn) AcceptStream() (Stream, error) {
+	return p.AcceptStreamContext(context.Background())
+}
+
+// AcceptStreamContext accepts a stream of the live connection,
+// it keeps accepting on the redialed connections
+func (p *PersistentConn) AcceptStreamContext(ctx context.Context) (Stream, error) {
+	p.mu.Lock()
+	deadline := p.deadline
+	p.mu.Unlock()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	return p.do(ctx, func(conn Conn) (Stream, error) {
+		return conn.AcceptStreamContext(ctx)
+	})
+}
+
+// Close stops redialing and closes the connection
+func (p *PersistentConn) Close() {
+	p.cancel()
+	<-p.exited
+}
+
+func (p *PersistentConn) IsClosed() bool {
+	return p.ctx.Err() != nil
+}
+
+// lastConn returns the live connection or the last one
+func (p *PersistentConn) lastConn() Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// RemoteAddr returns the remote address of the live or the last
+// connection, nil before the first one
+func (p *PersistentConn) RemoteAddr() net.Addr {
+	conn := p.lastConn()
+	if conn == nil {
+		return nil
+	}
+	return conn.RemoteAddr()
+}
+
+func (p *PersistentConn) LocalAddr() net.Addr {
+	conn := p.lastConn()
+	if conn == nil {
+		return nil
+	}
+	return conn.LocalAddr()
+}
+
+// SetDeadline sets the deadline of AcceptStream
+func (p *PersistentConn) SetDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.deadline = t
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *PersistentConn) Identity() interface{} {
+	conn := p.lastConn()
+	if conn == nil {
+		return nil
+	}
+	return conn.Identity()
+}
+
+func (p *PersistentConn) Metadata() map[string]string {
+	conn := p.lastConn()
+	if conn == nil {
+		return nil
+	}
+	return conn.Metadata()
+}
@@ -0,0 +1,253 @@
+package optw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/smartystreets/goconvey/convey"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a Conn whose streams are pipes, Close kills it
+type fakeConn struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (c *fakeConn) OpenStream() (Stream, error) {
+	return c.OpenStreamContext(context.Background())
+}
+
+func (c *fakeConn) OpenStreamContext(ctx context.Context) (Stream, error) {
+	if c.IsClosed() {
+		return nil, Wrap(ErrConnClosed, net.ErrClosed)
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func (c *fakeConn) AcceptStream() (Stream, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+func (c *fakeConn) AcceptStreamContext(ctx context.Context) (Stream, error) {
+	select {
+	case <-c.closed:
+		return nil, Wrap(ErrConnClosed, net.ErrClosed)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeConn) Close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+func (c *fakeConn) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr          { return nil }
+func (c *fakeConn) LocalAddr() net.Addr           { return nil }
+func (c *fakeConn) SetDeadline(t time.Time) error { return nil }
+func (c *fakeConn) Identity() interface{}         { return nil }
+func (c *fakeConn) Metadata() map[string]string   { return nil }
+
+// fakeDialer hands out fakeConns on conns, it fails while down
+// and with err if set
+type fakeDialer struct {
+	mu    sync.Mutex
+	down  bool
+	err   error
+	conns chan *fakeConn
+}
+
+func (d *fakeDialer) setDown(down bool) {
+	d.mu.Lock()
+	d.down = down
+	d.mu.Unlock()
+}
+
+func (d *fakeDialer) Dial() (Conn, error) {
+	return d.DialContext(context.Background())
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context) (Conn, error) {
+	d.mu.Lock()
+	down, err := d.down, d.err
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if down {
+		return nil, fmt.Errorf("server down")
+	}
+
+	conn := newFakeConn()
+	select {
+	case d.conns <- conn:
+	default:
+	}
+	return conn, nil
+}
+
+func (d *fakeDialer) SetAccessToken(accessToken string) {}
+func (d *fakeDialer) SetMetadata(md map[string]string)  {}
+func (d *fakeDialer) SetOptions(opts ...Option)         {}
+
+// stateRecorder collects the state changes
+type stateRecorder struct {
+	states chan ConnState
+}
+
+func (r *stateRecorder) onStateChange(state ConnState, err error) {
+	r.states <- state
+}
+
+func (r *stateRecorder) next() ConnState {
+	select {
+	case state := <-r.states:
+		return state
+	case <-time.After(time.Second * 5):
+		return ConnState(-1)
+	}
+}
+
+func TestPersistentConn(t *testing.T) {
+	convey.Convey("test persistent conn", t, func() {
+		dialer := &fakeDialer{conns: make(chan *fakeConn, 8)}
+		recorder := &stateRecorder{states: make(chan ConnState, 64)}
+		cfg := PersistentConfig{
+			MinBackoff:    time.Millisecond * 10,
+			MaxBackoff:    time.Millisecond * 40,
+			CheckInterval: time.Millisecond * 10,
+			OnStateChange: recorder.onStateChange,
+		}
+
+		convey.Convey("test redial once the connection dies", func() {
+			conn := NewPersistentConn(dialer, cfg)
+			defer conn.Close()
+			convey.So(recorder.next(), convey.ShouldEqual, StateConnected)
+			convey.So(conn.State(), convey.ShouldEqual, StateConnected)
+
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			stream.Close()
+
+			first := <-dialer.conns
+			first.Close()
+			convey.So(recorder.next(), convey.ShouldEqual, StateDisconnected)
+			convey.So(recorder.next(), convey.ShouldEqual, StateConnected)
+			second := <-dialer.conns
+			convey.So(second, convey.ShouldNotEqual, first)
+
+			stream, err = conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			stream.Close()
+		})
+
+		convey.Convey("test retry with backoff", func() {
+			dialer.setDown(true)
+			conn := NewPersistentConn(dialer, cfg)
+			defer conn.Close()
+			convey.So(recorder.next(), convey.ShouldEqual, StateRetrying)
+			convey.So(recorder.next(), convey.ShouldEqual, StateRetrying)
+
+			// OpenStream waits for the redial
+			opened := make(chan error, 1)
+			go func() {
+				stream, err := conn.OpenStream()
+				if err == nil {
+					stream.Close()
+				}
+				opened <- err
+			}()
+			select {
+			case <-opened:
+				t.Fatal("open stream while reconnecting")
+			case <-time.After(time.Millisecond * 50):
+			}
+
+			dialer.setDown(false)
+			convey.So(<-opened, convey.ShouldBeNil)
+			convey.So(conn.State(), convey.ShouldEqual, StateConnected)
+		})
+
+		convey.Convey("test fail fast", func() {
+			dialer.setDown(true)
+			cfg.FailFast = true
+			conn := NewPersistentConn(dialer, cfg)
+			defer conn.Close()
+			convey.So(recorder.next(), convey.ShouldEqual, StateRetrying)
+
+			_, err := conn.OpenStream()
+			convey.So(errors.Is(err, ErrConnClosed), convey.ShouldBeTrue)
+			_, err = conn.AcceptStream()
+			convey.So(errors.Is(err, ErrConnClosed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test permanent dial error", func() {
+			dialer.err = fmt.Errorf("%w: wrong token", ErrAuthFailed)
+			conn := NewPersistentConn(dialer, cfg)
+			defer conn.Close()
+			convey.So(recorder.next(), convey.ShouldEqual, StateFailed)
+			// no retry follows
+			time.Sleep(time.Millisecond * 50)
+			convey.So(recorder.states, convey.ShouldBeEmpty)
+
+			convey.So(conn.IsClosed(), convey.ShouldBeTrue)
+			convey.So(errors.Is(conn.Err(), ErrAuthFailed), convey.ShouldBeTrue)
+			_, err := conn.OpenStream()
+			convey.So(errors.Is(err, ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(err, ErrConnClosed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test context and deadline", func() {
+			dialer.setDown(true)
+			conn := NewPersistentConn(dialer, cfg)
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			_, err := conn.OpenStreamContext(ctx)
+			convey.So(errors.Is(err, context.DeadlineExceeded), convey.ShouldBeTrue)
+
+			dialer.setDown(false)
+			conn.SetDeadline(time.Now().Add(time.Millisecond * 50))
+			_, err = conn.AcceptStream()
+			convey.So(errors.Is(err, context.DeadlineExceeded), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test close", func() {
+			conn := NewPersistentConn(dialer, cfg)
+			convey.So(recorder.next(), convey.ShouldEqual, StateConnected)
+			live := <-dialer.conns
+
+			accepted := make(chan error, 1)
+			go func() {
+				_, err := conn.AcceptStream()
+				accepted <- err
+			}()
+			conn.Close()
+			convey.So(conn.IsClosed(), convey.ShouldBeTrue)
+			convey.So(live.IsClosed(), convey.ShouldBeTrue)
+			convey.So(errors.Is(<-accepted, ErrConnClosed), convey.ShouldBeTrue)
+
+			_, err := conn.OpenStream()
+			convey.So(errors.Is(err, net.ErrClosed), convey.ShouldBeTrue)
+		})
+	})
+}
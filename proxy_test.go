@@ -0,0 +1,216 @@
+package optw
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveSocks5 runs a socks5 proxy on l, it requires user:pass
+// if user is set
+func serveSocks5(l net.Listener, user, pass string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			target, err := socks5Accept(conn, user, pass)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+func socks5Accept(conn net.Conn, user, pass string) (net.Conn, error) {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return nil, err
+	}
+	methods := make([]byte, head[1])
+	io.ReadFull(conn, methods)
+
+	want := byte(socks5AuthNone)
+	if len(user) > 0 {
+		want = socks5AuthPass
+	}
+	if !bytes.Contains(methods, []byte{want}) {
+		conn.Write([]byte{socks5Version, socks5NoAuth})
+		return nil, fmt.Errorf("no acceptable method")
+	}
+	conn.Write([]byte{socks5Version, want})
+
+	if want == socks5AuthPass {
+		buf := make([]byte, 2)
+		io.ReadFull(conn, buf)
+		name := make([]byte, buf[1])
+		io.ReadFull(conn, name)
+		io.ReadFull(conn, buf[:1])
+		secret := make([]byte, buf[0])
+		io.ReadFull(conn, secret)
+		if string(name) != user || string(secret) != pass {
+			conn.Write([]byte{1, 1})
+			return nil, fmt.Errorf("invalid credentials")
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 4)
+	_, err = io.ReadFull(conn, req)
+	if err != nil {
+		return nil, err
+	}
+	var host string
+	switch req[3] {
+	case socks5IPv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socks5Domain:
+		l := make([]byte, 1)
+		io.ReadFull(conn, l)
+		name := make([]byte, l[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{socks5Version, 5, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	conn.Write([]byte{socks5Version, 0, 0, socks5IPv4, 127, 0, 0, 1, 0, 0})
+	return target, nil
+}
+
+// connectHandler is a http CONNECT proxy requiring the basic auth user:pass
+func connectHandler(user, pass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := proxyBasicAuth(r)
+		if !ok || u != user || p != pass {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	})
+}
+
+func proxyBasicAuth(r *http.Request) (string, string, bool) {
+	r.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+	return r.BasicAuth()
+}
+
+// serveBanner writes a banner to each client then echoes
+func serveBanner(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.Write([]byte("banner"))
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func TestProxy(t *testing.T) {
+	convey.Convey("test proxy dial", t, func() {
+		server, err := net.Listen("tcp", "127.0.0.1:0")
+		convey.So(err, convey.ShouldBeNil)
+		defer server.Close()
+		go serveBanner(server)
+
+		socks, err := net.Listen("tcp", "127.0.0.1:0")
+		convey.So(err, convey.ShouldBeNil)
+		defer socks.Close()
+		go serveSocks5(socks, "user", "pass")
+
+		connect, err := net.Listen("tcp", "127.0.0.1:0")
+		convey.So(err, convey.ShouldBeNil)
+		defer connect.Close()
+		go http.Serve(connect, connectHandler("user", "pass"))
+
+		dial := func(proxy string) (net.Conn, error) {
+			cfg := ProxyConfig{Proxy: proxy}
+			return cfg.ProxyDial(context.Background(), &net.Dialer{}, server.Addr().String(), time.Second)
+		}
+		echo := func(conn net.Conn) {
+			defer conn.Close()
+			buf := make([]byte, 6)
+			_, err := io.ReadFull(conn, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "banner")
+
+			conn.Write([]byte("ping"))
+			_, err = io.ReadFull(conn, buf[:4])
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf[:4]), convey.ShouldEqual, "ping")
+		}
+
+		convey.Convey("test socks5", func() {
+			conn, err := dial("socks5://user:pass@" + socks.Addr().String())
+			convey.So(err, convey.ShouldBeNil)
+			echo(conn)
+
+			_, err = dial("socks5://user:invalid@" + socks.Addr().String())
+			convey.So(errors.Is(err, ErrProxyAuth), convey.ShouldBeTrue)
+			_, err = dial("socks5://" + socks.Addr().String())
+			convey.So(errors.Is(err, ErrProxyAuth), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test http connect", func() {
+			conn, err := dial("http://user:pass@" + connect.Addr().String())
+			convey.So(err, convey.ShouldBeNil)
+			echo(conn)
+
+			_, err = dial("http://user:invalid@" + connect.Addr().String())
+			convey.So(errors.Is(err, ErrProxyAuth), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test invalid proxy", func() {
+			_, err := dial("ftp://" + connect.Addr().String())
+			convey.So(err, convey.ShouldNotBeNil)
+
+			// the proxy does not answer
+			silent, err := net.Listen("tcp", "127.0.0.1:0")
+			convey.So(err, convey.ShouldBeNil)
+			defer silent.Close()
+			_, err = dial("socks5://" + silent.Addr().String())
+			convey.So(errors.Is(err, ErrHandshakeTimeout), convey.ShouldBeTrue)
+			convey.So(errors.Is(err, ErrProxyAuth), convey.ShouldBeFalse)
+		})
+	})
+}
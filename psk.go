@@ -0,0 +1,255 @@
+package optw
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// psk encryption layer, each side sends a random salt and the key of
+// each direction is derived from the psk and both salts, so a replayed
+// session does not decrypt. The frames are sealed with a counter nonce,
+// a tampered, reordered or replayed frame fails to open:
+//
+//	client hello: | salt 32 |
+//	server hello: | salt 32 |
+//	frame:        | sealed payload length 2 | tag | sealed payload | tag |
+//
+// a frame failing to open closes the connection with ErrFrameAuth.
+const (
+	pskSaltSize   = 32
+	pskMaxPayload = 0x3fff
+
+	CipherChacha20Poly1305 = "chacha20-poly1305"
+	CipherAES256GCM        = "aes-256-gcm"
+)
+
+var (
+	pskC2SLabel = []byte("optw psk c2s")
+	pskS2CLabel = []byte("optw psk s2c")
+)
+
+// PSKConfig is embedded in the configs of the stream transports
+type PSKConfig struct {
+	// pre-shared key of the encryption layer, empty disables it
+	PSK string `json:"psk"`
+	// aead cipher, chacha20-poly1305 by default or aes-256-gcm
+	PSKCipher string `json:"pskCipher"`
+}
+
+// PSKEnabled reports whether the psk encryption layer is enabled
+func (c PSKConfig) PSKEnabled() bool {
+	return len(c.PSK) > 0
+}
+
+// PSKClient runs the client side salt exchange over conn
+// and returns the encrypted connection.
+// The caller sets the handshake deadline.
+func (c PSKConfig) PSKClient(conn net.Conn) (net.Conn, error) {
+	clientSalt, err := c.writeSalt(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	serverSalt := make([]byte, pskSaltSize)
+	_, err = io.ReadFull(conn, serverSalt)
+	if err != nil {
+		return nil, fmt.Errorf("read psk salt fail: %w", err)
+	}
+	return c.newConn(conn, clientSalt, serverSalt, pskC2SLabel, pskS2CLabel)
+}
+
+// PSKServer runs the server side salt exchange over conn
+// and returns the encrypted connection.
+// The caller sets the handshake deadline.
+func (c PSKConfig) PSKServer(conn net.Conn) (net.Conn, error) {
+	clientSalt := make([]byte, pskSaltSize)
+	_, err := io.ReadFull(conn, clientSalt)
+	if err != nil {
+		return nil, fmt.Errorf("read psk salt fail: %w", err)
+	}
+
+	serverSalt, err := c.writeSalt(conn)
+	if err != nil {
+		return nil, err
+	}
+	return c.newConn(conn, clientSalt, serverSalt, pskS2CLabel, pskC2SLabel)
+}
+
+func (c PSKConfig) writeSalt(conn net.Conn) ([]byte, error) {
+	salt := make([]byte, pskSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(salt)
+	if err != nil {
+		return nil, fmt.Errorf("write psk salt fail: %w", err)
+	}
+	return salt, nil
+}
+
+// newConn derives the sealing key from sealLabel and the opening key
+// from openLabel
+func (c PSKConfig) newConn(conn net.Conn, clientSalt, serverSalt, sealLabel, openLabel []byte) (net.Conn, error) {
+	salt := append(append([]byte(nil), clientSalt...), serverSalt...)
+	seal, err := c.aead(salt, sealLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	open, err := c.aead(salt, openLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pskConn{
+		Conn:      conn,
+		seal:      seal,
+		open:      open,
+		sealNonce: make([]byte, seal.NonceSize()),
+		openNonce: make([]byte, open.NonceSize()),
+	}, nil
+}
+
+func (c PSKConfig) aead(salt, label []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(c.PSK), salt, label), key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.PSKCipher {
+	case "", CipherChacha20Poly1305:
+		return chacha20poly1305.New(key)
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, fmt.Errorf("unsupported psk cipher %s", c.PSKCipher)
+	}
+}
+
+// pskConn seals each write into frames of up to pskMaxPayload bytes
+type pskConn struct {
+	net.Conn
+	seal      cipher.AEAD
+	open      cipher.AEAD
+	sealNonce []byte
+	openNonce []byte
+
+	wmu     sync.Mutex
+	rmu     sync.Mutex
+	rbuf    []byte
+	openErr error
+}
+
+func (c *pskConn) Read(buf []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rbuf) <= 0 {
+		if c.openErr != nil {
+			return 0, c.openErr
+		}
+
+		err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(buf, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *pskConn) readFrame() error {
+	hdr, err := c.readSealed(2)
+	if err != nil {
+		return err
+	}
+
+	payload, err := c.readSealed(int(binary.BigEndian.Uint16(hdr)))
+	if err != nil {
+		return err
+	}
+	c.rbuf = payload
+	return nil
+}
+
+// readSealed reads and opens a sealed chunk of n plaintext bytes,
+// a chunk failing to open tears the connection down
+func (c *pskConn) readSealed(n int) ([]byte, error) {
+	if n > pskMaxPayload {
+		return nil, c.fail(fmt.Errorf("%w: invalid frame length %d", ErrFrameAuth, n))
+	}
+
+	buf := make([]byte, n+c.open.Overhead())
+	_, err := io.ReadFull(c.Conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := c.open.Open(buf[:0], c.openNonce, buf, nil)
+	if err != nil {
+		return nil, c.fail(fmt.Errorf("%w: %v", ErrFrameAuth, err))
+	}
+	increment(c.openNonce)
+	return plain, nil
+}
+
+func (c *pskConn) fail(err error) error {
+	c.openErr = err
+	c.Conn.Close()
+	return err
+}
+
+func (c *pskConn) Write(buf []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	overhead := 2 + 2*c.seal.Overhead()
+	out := make([]byte, 0, len(buf)+(len(buf)/pskMaxPayload+1)*overhead)
+	for data := buf; len(data) > 0; {
+		n := len(data)
+		if n > pskMaxPayload {
+			n = pskMaxPayload
+		}
+
+		out = c.seal.Seal(out, c.sealNonce, binary.BigEndian.AppendUint16(nil, uint16(n)), nil)
+		increment(c.sealNonce)
+		out = c.seal.Seal(out, c.sealNonce, data[:n], nil)
+		increment(c.sealNonce)
+		data = data[n:]
+	}
+
+	_, err := c.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// increment increments the little endian counter nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
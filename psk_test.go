@@ -0,0 +1,114 @@
+package optw
+
+import (
+	"bytes"
+	"errors"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+)
+
+var (
+	testClientSalt = bytes.Repeat([]byte{1}, pskSaltSize)
+	testServerSalt = bytes.Repeat([]byte{2}, pskSaltSize)
+)
+
+// sealFrames returns the client frames of payloads on the wire
+func sealFrames(cfg PSKConfig, payloads ...[]byte) []byte {
+	raw, peer := net.Pipe()
+	defer raw.Close()
+	go io.Copy(io.Discard, peer)
+
+	rec := &recordConn{Conn: raw}
+	conn, err := cfg.newConn(rec, testClientSalt, testServerSalt, pskC2SLabel, pskS2CLabel)
+	convey.So(err, convey.ShouldBeNil)
+	for _, payload := range payloads {
+		conn.Write(payload)
+	}
+	return rec.written.Bytes()
+}
+
+// openFrames reads the client frames on the wire by the server side
+func openFrames(cfg PSKConfig, wire []byte) ([]byte, error) {
+	raw, peer := net.Pipe()
+	go func() {
+		peer.Write(wire)
+		peer.Close()
+	}()
+
+	conn, err := cfg.newConn(raw, testClientSalt, testServerSalt, pskS2CLabel, pskC2SLabel)
+	convey.So(err, convey.ShouldBeNil)
+	return io.ReadAll(conn)
+}
+
+func TestPSK(t *testing.T) {
+	convey.Convey("test psk encryption layer", t, func() {
+		cfg := PSKConfig{PSK: "test psk"}
+		payload := bytes.Repeat([]byte("smux"), pskMaxPayload)
+
+		convey.Convey("test ciphers", func() {
+			for _, name := range []string{CipherChacha20Poly1305, CipherAES256GCM} {
+				cfg.PSKCipher = name
+				wire := sealFrames(cfg, payload)
+				convey.So(bytes.Contains(wire, []byte("smuxsmux")), convey.ShouldBeFalse)
+
+				data, err := openFrames(cfg, wire)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(data, convey.ShouldResemble, payload)
+			}
+
+			cfg.PSKCipher = "rc4"
+			_, err := cfg.newConn(nil, testClientSalt, testServerSalt, pskC2SLabel, pskS2CLabel)
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test tampered frame", func() {
+			wire := sealFrames(cfg, []byte("ping"))
+			wire[len(wire)-1] ^= 0xff
+			_, err := openFrames(cfg, wire)
+			convey.So(errors.Is(err, ErrFrameAuth), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test replayed frame", func() {
+			wire := sealFrames(cfg, []byte("ping"))
+			data, err := openFrames(cfg, append(wire, wire...))
+			convey.So(errors.Is(err, ErrFrameAuth), convey.ShouldBeTrue)
+			convey.So(string(data), convey.ShouldEqual, "ping")
+		})
+
+		convey.Convey("test wrong psk", func() {
+			wire := sealFrames(cfg, []byte("ping"))
+			_, err := openFrames(PSKConfig{PSK: "invalid psk"}, wire)
+			convey.So(errors.Is(err, ErrFrameAuth), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test salt exchange", func() {
+			client, server := net.Pipe()
+			defer client.Close()
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := cfg.PSKServer(server)
+				if err != nil {
+					t.Error("err should be nil, got ", err)
+				}
+				accepted <- conn
+			}()
+
+			cconn, err := cfg.PSKClient(client)
+			convey.So(err, convey.ShouldBeNil)
+			sconn := <-accepted
+
+			go cconn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(sconn, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+
+			go sconn.Write([]byte("pong"))
+			_, err = io.ReadFull(cconn, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "pong")
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package quic
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/ICKelin/optw"
+	quic_go "github.com/quic-go/quic-go"
+)
+
+type Config struct {
+	// tls application protocols
+	ALPN []string `json:"alpn"`
+	// keepalive in seconds
+	KeepAlivePeriod int `json:"keepAlivePeriod"`
+	optw.HandshakeConfig
+	optw.TLSConfig
+}
+
+var defaultConfig = Config{
+	ALPN:            []string{"ickelin/optw"},
+	KeepAlivePeriod: 10,
+	HandshakeConfig: optw.DefaultHandshakeConfig,
+}
+
+// DefaultConfig returns the default quic config
+func DefaultConfig() Config {
+	return defaultConfig
+}
+
+// tlsConfig returns conf with the configured ALPN,
+// or the one built from the TLSConfig if conf is nil,
+// addr is the server address of a dialer and empty for a listener
+func (c Config) tlsConfig(conf *tls.Config, addr string) (*tls.Config, error) {
+	if conf == nil {
+		if len(addr) <= 0 {
+			return c.ServerTLS(c.ALPN)
+		}
+		return c.ClientTLS(addr, c.ALPN)
+	}
+
+	conf = conf.Clone()
+	if len(conf.NextProtos) <= 0 {
+		conf.NextProtos = c.ALPN
+	}
+	return conf, nil
+}
+
+// quicConfig returns the quic config, the keepalive options take
+// precedence over the configured period, the timeout is the idle timeout
+func (c Config) quicConfig(opts optw.Options) *quic_go.Config {
+	period, timeout := opts.KeepAlive(time.Second*time.Duration(c.KeepAlivePeriod), 0)
+	return &quic_go.Config{
+		KeepAlivePeriod: period,
+		MaxIdleTimeout:  timeout,
+	}
+}
@@ -9,35 +9,56 @@ import (
 )
 
 type Conn struct {
-	close bool
-	conn  quic_go.Connection
+	conn     quic_go.Connection
+	identity interface{}
+	metadata map[string]string
 }
 
 func (c *Conn) OpenStream() (optw.Stream, error) {
 	stream, err := c.conn.OpenStream()
 	if err != nil {
-		return nil, err
+		return nil, mapError(err)
+	}
+
+	return &Stream{rawConn: c, Stream: stream}, nil
+}
+
+// OpenStreamContext waits until the peer allows a new stream or ctx is done
+func (c *Conn) OpenStreamContext(ctx context.Context) (optw.Stream, error) {
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, mapError(err)
 	}
 
 	return &Stream{rawConn: c, Stream: stream}, nil
 }
 
 func (c *Conn) AcceptStream() (optw.Stream, error) {
-	stream, err := c.conn.AcceptStream(context.Background())
+	return c.AcceptStreamContext(context.Background())
+}
+
+func (c *Conn) AcceptStreamContext(ctx context.Context) (optw.Stream, error) {
+	stream, err := c.conn.AcceptStream(ctx)
 	if err != nil {
-		return nil, err
+		return nil, mapError(err)
 	}
 
 	return &Stream{rawConn: c, Stream: stream}, nil
 }
 
 func (c *Conn) Close() {
-	c.conn.CloseWithError(0, "")
-	c.close = true
+	c.conn.CloseWithError(codeNoError, "")
 }
 
+// IsClosed reports whether the connection is closed by either side
+// or by the idle timeout
 func (c *Conn) IsClosed() bool {
-	return c.close
+	select {
+	case <-c.conn.Context().Done():
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
@@ -51,3 +72,11 @@ func (c *Conn) LocalAddr() net.Addr {
 func (c *Conn) SetDeadline(t time.Time) error {
 	return nil
 }
+
+func (c *Conn) Identity() interface{} {
+	return c.identity
+}
+
+func (c *Conn) Metadata() map[string]string {
+	return c.metadata
+}
@@ -0,0 +1,56 @@
+package quic
+
+import (
+	"errors"
+
+	"github.com/ICKelin/optw"
+	quic_go "github.com/quic-go/quic-go"
+)
+
+// application error codes sent with CONNECTION_CLOSE,
+// so that the remote side learns why it was rejected
+const (
+	codeNoError          quic_go.ApplicationErrorCode = 0x0
+	codeAuthFailed       quic_go.ApplicationErrorCode = 0x101
+	codeHandshakeTimeout quic_go.ApplicationErrorCode = 0x102
+	codeHandshakeFailed  quic_go.ApplicationErrorCode = 0x103
+)
+
+// closeWithError closes conn with the application error code of err
+func closeWithError(conn quic_go.Connection, err error) {
+	switch {
+	case errors.Is(err, optw.ErrAuthFailed):
+		conn.CloseWithError(codeAuthFailed, "auth failed")
+	case errors.Is(err, optw.ErrHandshakeTimeout):
+		conn.CloseWithError(codeHandshakeTimeout, "handshake timeout")
+	default:
+		conn.CloseWithError(codeHandshakeFailed, "handshake failed")
+	}
+}
+
+// mapError wraps quic-go errors with the optw ones
+func mapError(err error) error {
+	var appErr *quic_go.ApplicationError
+	if errors.As(err, &appErr) {
+		switch appErr.ErrorCode {
+		case codeAuthFailed:
+			return optw.Wrap(optw.ErrAuthFailed, err)
+		case codeHandshakeTimeout:
+			return optw.Wrap(optw.ErrHandshakeTimeout, err)
+		default:
+			return optw.Wrap(optw.ErrConnClosed, err)
+		}
+	}
+
+	var streamErr *quic_go.StreamError
+	if errors.As(err, &streamErr) {
+		return optw.Wrap(optw.ErrStreamReset, err)
+	}
+
+	var idleErr *quic_go.IdleTimeoutError
+	var resetErr *quic_go.StatelessResetError
+	if errors.As(err, &idleErr) || errors.As(err, &resetErr) {
+		return optw.Wrap(optw.ErrConnClosed, err)
+	}
+	return err
+}
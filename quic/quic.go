@@ -2,14 +2,9 @@ package quic
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"github.com/ICKelin/optw"
 	quic_go "github.com/quic-go/quic-go"
-	"math/big"
 	"net"
 	"time"
 )
@@ -17,60 +12,126 @@ import (
 var _ optw.Listener = &Listener{}
 var _ optw.Dialer = &Dialer{}
 
-var nextProtocols = []string{
-	"ickelin/optw",
+const scheme = "quic"
+
+func init() {
+	optw.RegisterConfig(scheme, defaultConfig, NewListenerWithConfig, NewDialerWithConfig)
 }
 
 type Listener struct {
-	addr     string
-	listener *quic_go.Listener
-	authFn   func(token string) bool
+	addr      string
+	config    Config
+	tlsConfig *tls.Config
+	listener  *quic_go.Listener
+	options   optw.Options
+	optw.ServerAuth
+	acceptor *optw.Acceptor
 }
 
 func NewListener(addr string) *Listener {
-	return &Listener{addr: addr}
+	return NewListenerWithConfig(addr, defaultConfig)
+}
+
+func NewListenerWithConfig(addr string, cfg Config) *Listener {
+	return &Listener{addr: addr, config: cfg}
+}
+
+// SetOptions sets the options shared by the transports,
+// it takes effect on Listen
+func (l *Listener) SetOptions(opts ...optw.Option) {
+	l.options.Apply(opts...)
+	l.config.HandshakeConfig = l.options.Handshake(l.config.HandshakeConfig)
+}
+
+// SetTLSConfig sets the tls config used instead of the one built
+// from the certificate files, it takes effect on Listen
+func (l *Listener) SetTLSConfig(conf *tls.Config) {
+	l.tlsConfig = conf
 }
 
 func (l *Listener) Listen() error {
-	tlsConfig, err := generateTLSConfig()
+	tlsConfig, err := l.config.tlsConfig(l.tlsConfig, "")
 	if err != nil {
 		return err
 	}
-	listener, err := quic_go.ListenAddr(l.addr, tlsConfig, &quic_go.Config{
-		KeepAlivePeriod: time.Second * 10,
-	})
+	listener, err := quic_go.ListenAddr(l.addr, tlsConfig, l.config.quicConfig(l.options))
 	if err != nil {
 		return err
 	}
 	l.listener = listener
+	l.acceptor = optw.NewAcceptor(l.config.Concurrency())
+	go l.acceptor.Serve(l.accept)
 	return nil
 }
 
+// Accept returns the next connection which passed the handshake,
+// a failed handshake is returned as error and the listener keeps accepting.
 func (l *Listener) Accept() (optw.Conn, error) {
+	return l.acceptor.Accept()
+}
+
+func (l *Listener) AcceptContext(ctx context.Context) (optw.Conn, error) {
+	return l.acceptor.AcceptContext(ctx)
+}
+
+func (l *Listener) accept() (func() (optw.Conn, error), error) {
 	conn, err := l.listener.Accept(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	if l.authFn != nil {
-		stream, err := conn.AcceptStream(context.Background())
+	return func() (optw.Conn, error) {
+		return l.handshake(conn)
+	}, nil
+}
+
+func (l *Listener) handshake(conn quic_go.Connection) (optw.Conn, error) {
+	var identity interface{}
+	var err error
+	info := &optw.AuthInfo{RemoteAddr: conn.RemoteAddr(), Scheme: scheme}
+
+	// mTLS, the verified client certificate identifies the client
+	info.Certificate = optw.PeerCertificate(conn.ConnectionState().TLS)
+	if info.Certificate != nil {
+		info.Identity = optw.CertIdentity(info.Certificate)
+	}
+
+	switch {
+	case info.Certificate != nil && !l.ServerAuth.TokenEnabled():
+		identity, err = optw.VerifyPeer(&l.ServerAuth, info)
+		if err != nil {
+			closeWithError(conn, err)
+			return nil, err
+		}
+	case l.ServerAuth.Enabled():
+		deadline := time.Now().Add(l.config.Timeout())
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
+			err = optw.HandshakeError(mapError(err), deadline)
+			closeWithError(conn, err)
 			return nil, err
 		}
 		defer stream.Close()
 
-		stream.SetDeadline(time.Now().Add(time.Second * 5))
-		err = optw.VerifyAuth(stream, l.authFn)
+		stream.SetDeadline(deadline)
+		identity, err = optw.VerifyAuth(stream, &l.ServerAuth, info)
 		stream.SetDeadline(time.Time{})
 		if err != nil {
+			err = optw.HandshakeError(mapError(err), deadline)
+			closeWithError(conn, err)
 			return nil, err
 		}
 	}
 
-	return &Conn{close: false, conn: conn}, nil
+	return &Conn{conn: conn, identity: identity, metadata: info.Metadata}, nil
 }
 
 func (l *Listener) Close() error {
+	if l.acceptor != nil {
+		l.acceptor.Close()
+	}
 	if l.listener != nil {
 		l.listener.Close()
 	}
@@ -81,73 +142,120 @@ func (l *Listener) Addr() net.Addr {
 	return l.listener.Addr()
 }
 
-func (l *Listener) SetAuthFunc(f func(token string) bool) {
-	l.authFn = f
-}
-
 type Dialer struct {
 	addr        string
+	config      Config
+	tlsConfig   *tls.Config
 	accessToken string
+	metadata    map[string]string
+	options     optw.Options
 }
 
 func NewDialer(addr string) *Dialer {
-	return &Dialer{addr: addr}
+	return NewDialerWithConfig(addr, defaultConfig)
+}
+
+func NewDialerWithConfig(addr string, cfg Config) *Dialer {
+	return &Dialer{addr: addr, config: cfg}
 }
 
 func (d *Dialer) Dial() (optw.Conn, error) {
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         nextProtocols,
-	}
-	conn, err := quic_go.DialAddr(context.Background(), d.addr, tlsConf, &quic_go.Config{
-		KeepAlivePeriod: time.Second * 10,
-	})
+	return d.DialContext(context.Background())
+}
+
+func (d *Dialer) DialContext(ctx context.Context) (optw.Conn, error) {
+	tlsConf, err := d.config.tlsConfig(d.tlsConfig, d.addr)
 	if err != nil {
 		return nil, err
 	}
+	conn, err := d.dial(ctx, tlsConf)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	c := &Conn{conn: conn, metadata: d.metadata}
 
 	// enable auth
 	if len(d.accessToken) > 0 {
-		stream, err := conn.OpenStream()
+		raw, err := conn.OpenStreamSync(ctx)
 		if err != nil {
-			return nil, err
+			conn.CloseWithError(codeNoError, "")
+			return nil, mapError(err)
 		}
+		stream, release := optw.WithContext(ctx, &Stream{rawConn: c, Stream: raw})
 		defer stream.Close()
 
-		stream.SetDeadline(time.Now().Add(time.Second * 5))
-		err = optw.AuthRequest(stream, d.accessToken)
+		deadline := time.Now().Add(d.config.Timeout())
+		stream.SetDeadline(deadline)
+		err = d.options.AuthRequest(stream, d.accessToken, d.metadata)
 		stream.SetDeadline(time.Time{})
+		if err == nil {
+			err = release()
+		}
 		if err != nil {
+			err = optw.ContextError(ctx, optw.HandshakeError(mapError(err), deadline))
+			closeWithError(conn, err)
 			return nil, err
 		}
 	}
 
-	return &Conn{close: false, conn: conn}, nil
+	return c, nil
+}
+
+// SetTLSConfig sets the tls config used instead of the one built
+// from the CA file and server name
+func (d *Dialer) SetTLSConfig(conf *tls.Config) {
+	d.tlsConfig = conf
 }
 
 func (d *Dialer) SetAccessToken(accessToken string) {
 	d.accessToken = accessToken
 }
 
-func generateTLSConfig() (*tls.Config, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
+func (d *Dialer) SetMetadata(md map[string]string) {
+	d.metadata = md
+}
+
+// SetOptions sets the options shared by the transports
+func (d *Dialer) SetOptions(opts ...optw.Option) {
+	d.options.Apply(opts...)
+	d.config.HandshakeConfig = d.options.Handshake(d.config.HandshakeConfig)
+}
+
+// dial runs the quic handshake bounded by the dial timeout,
+// from the local address option if set
+func (d *Dialer) dial(ctx context.Context, tlsConf *tls.Config) (quic_go.Connection, error) {
+	if d.options.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.options.DialTimeout)
+		defer cancel()
+	}
+
+	if len(d.options.LocalAddr) <= 0 {
+		return quic_go.DialAddr(ctx, d.addr, tlsConf, d.config.quicConfig(d.options))
+	}
+
+	laddr, err := d.options.UDPAddr("udp")
 	if err != nil {
 		return nil, err
 	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	raddr, err := net.ResolveUDPAddr("udp", d.addr)
 	if err != nil {
 		return nil, err
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	udp, err := net.ListenUDP("udp", laddr)
 	if err != nil {
 		return nil, err
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   nextProtocols,
-	}, nil
+	conn, err := quic_go.Dial(ctx, udp, raddr, tlsConf, d.config.quicConfig(d.options))
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+
+	// the socket is owned by the connection
+	go func() {
+		<-conn.Context().Done()
+		udp.Close()
+	}()
+	return conn, nil
 }
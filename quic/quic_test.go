@@ -1,12 +1,32 @@
 package quic
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/ICKelin/optw"
 	"github.com/smartystreets/goconvey/convey"
 	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
+// testConfig skips the verification of the ephemeral test certificates
+var testConfig = func() Config {
+	cfg := defaultConfig
+	cfg.InsecureSkipVerify = true
+	return cfg
+}()
+
+func newTestDialer(addr string) *Dialer {
+	return NewDialerWithConfig(addr, testConfig)
+}
+
 func TestQuic(t *testing.T) {
 	convey.Convey("test quic transport", t, func() {
 		convey.Convey("test quic normaly", func() {
@@ -16,7 +36,10 @@ func TestQuic(t *testing.T) {
 			defer l.Close()
 
 			sndbuf := "test buffer"
+			echoed := make(chan struct{})
+			srvDone := make(chan struct{})
 			go func() {
+				defer close(srvDone)
 				conn, err := l.Accept()
 				if err != nil {
 					t.Error("err should be nil")
@@ -38,9 +61,11 @@ func TestQuic(t *testing.T) {
 				if err != nil {
 					t.Error("err should be nil")
 				}
+				// keep the connection until the echo is read
+				<-echoed
 			}()
 
-			d := NewDialer("127.0.0.1:3445")
+			d := newTestDialer("127.0.0.1:3445")
 			conn, err := d.Dial()
 			convey.So(err, convey.ShouldBeNil)
 			defer conn.Close()
@@ -56,6 +81,38 @@ func TestQuic(t *testing.T) {
 			_, err = io.ReadFull(stream, buf)
 			convey.So(err, convey.ShouldBeNil)
 			convey.So(string(buf), convey.ShouldEqual, sndbuf)
+			close(echoed)
+		})
+
+		convey.Convey("test options", func() {
+			l := NewListener("127.0.0.1:3445")
+			l.SetOptions(optw.WithKeepAlive(time.Second, time.Second*5))
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			d := newTestDialer("127.0.0.1:3445")
+			d.SetOptions(
+				optw.WithDialTimeout(time.Second),
+				optw.WithLocalAddr("127.0.0.1"),
+				optw.WithKeepAlive(time.Second, time.Second*5),
+			)
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			convey.So(sconn.RemoteAddr().String(), convey.ShouldEqual, conn.LocalAddr().String())
+
+			// nothing answers on the port
+			d = newTestDialer("127.0.0.1:3446")
+			d.SetOptions(optw.WithDialTimeout(time.Millisecond * 200))
+			begin := time.Now()
+			_, err = d.Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(time.Since(begin), convey.ShouldBeLessThan, time.Second*2)
 		})
 
 		convey.Convey("test reconnect", func() {
@@ -64,7 +121,10 @@ func TestQuic(t *testing.T) {
 			convey.So(err, convey.ShouldBeNil)
 
 			sndbuf := "test buffer"
+			echoed := make(chan struct{})
+			srvDone := make(chan struct{})
 			go func() {
+				defer close(srvDone)
 				conn, err := l.Accept()
 				if err != nil {
 					t.Error("err should be nil")
@@ -86,9 +146,11 @@ func TestQuic(t *testing.T) {
 				if err != nil {
 					t.Error("err should be nil")
 				}
+				// keep the connection until the echo is read
+				<-echoed
 			}()
 
-			d := NewDialer("127.0.0.1:3445")
+			d := newTestDialer("127.0.0.1:3445")
 			conn, err := d.Dial()
 			convey.So(err, convey.ShouldBeNil)
 			defer conn.Close()
@@ -104,11 +166,15 @@ func TestQuic(t *testing.T) {
 			_, err = io.ReadFull(stream, buf)
 			convey.So(err, convey.ShouldBeNil)
 			convey.So(string(buf), convey.ShouldEqual, sndbuf)
+			close(echoed)
+			<-srvDone
+			time.Sleep(time.Millisecond * 100)
 
 			_, err = conn.OpenStream()
 			t.Log(err)
 			convey.So(err, convey.ShouldNotBeNil)
-			convey.So(conn.IsClosed(), convey.ShouldEqual, false)
+			// closed by the server
+			convey.So(conn.IsClosed(), convey.ShouldBeTrue)
 			conn.Close()
 			convey.So(conn.IsClosed(), convey.ShouldBeTrue)
 		})
@@ -127,8 +193,10 @@ func TestQuicAuth(t *testing.T) {
 			})
 			l.Listen()
 			defer l.Close()
-			d := NewDialer("127.0.0.1:2001")
+			d := newTestDialer("127.0.0.1:2001")
 			d.SetAccessToken("test auth")
+			// the auth func checks the plaintext token
+			d.SetOptions(optw.WithLegacyAuth(true))
 
 			go func() {
 				_, err := l.Accept()
@@ -153,25 +221,27 @@ func TestQuicAuth(t *testing.T) {
 			})
 			l.Listen()
 			defer l.Close()
-			d := NewDialer("127.0.0.1:2001")
+			d := newTestDialer("127.0.0.1:2001")
 			d.SetAccessToken("invalid test auth")
+			// the auth func checks the plaintext token
+			d.SetOptions(optw.WithLegacyAuth(true))
 
 			go func() {
 				_, err := l.Accept()
-				if err == nil {
-					t.Error("err should not be nil")
+				if !errors.Is(err, optw.ErrAuthFailed) {
+					t.Error("err should be ErrAuthFailed, got ", err)
 				}
 			}()
 
 			time.Sleep(time.Second * 1)
 			_, err := d.Dial()
-			convey.So(err, convey.ShouldNotBeNil)
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
 		})
 
 		convey.Convey("no auth test", func() {
 			l := NewListener("127.0.0.1:2001")
 			l.Listen()
-			d := NewDialer("127.0.0.1:2001")
+			d := newTestDialer("127.0.0.1:2001")
 
 			go func() {
 				_, err := l.Accept()
@@ -184,5 +254,271 @@ func TestQuicAuth(t *testing.T) {
 			_, err := d.Dial()
 			convey.So(err, convey.ShouldBeNil)
 		})
+
+		convey.Convey("test metadata", func() {
+			l := NewListener("127.0.0.1:2002")
+			l.SetAccessToken("test auth")
+			l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+				return info.Metadata["clientId"], nil
+			})
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+			d := newTestDialer("127.0.0.1:2002")
+			d.SetAccessToken("test auth")
+			d.SetMetadata(map[string]string{"clientId": "client-1", "version": "1.0.0"})
+
+			accepted := make(chan optw.Conn, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					t.Error("err should be nil, got ", err)
+				}
+				accepted <- conn
+			}()
+
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn := <-accepted
+			convey.So(sconn, convey.ShouldNotBeNil)
+			defer sconn.Close()
+			convey.So(sconn.Identity(), convey.ShouldEqual, "client-1")
+			convey.So(sconn.Metadata()["version"], convey.ShouldEqual, "1.0.0")
+		})
+	})
+}
+
+func TestQuicTLS(t *testing.T) {
+	convey.Convey("test optw transport/quic tls", t, func() {
+		dir := t.TempDir()
+		lcfg := defaultConfig
+		lcfg.CertFile = filepath.Join(dir, "cert.pem")
+		lcfg.KeyFile = filepath.Join(dir, "key.pem")
+		lcfg.GenerateCert = true
+		lcfg.ServerName = "optw.test"
+		l := NewListenerWithConfig("127.0.0.1:2003", lcfg)
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if err == nil {
+					conn.Close()
+				}
+			}
+		}()
+
+		convey.Convey("test verified server", func() {
+			cfg := defaultConfig
+			cfg.CAFile = lcfg.CertFile
+			cfg.ServerName = "optw.test"
+			conn, err := NewDialerWithConfig("127.0.0.1:2003", cfg).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+		})
+
+		convey.Convey("test unknown server", func() {
+			cfg := defaultConfig
+			cfg.ServerName = "optw.test"
+			_, err := NewDialerWithConfig("127.0.0.1:2003", cfg).Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test server name mismatch", func() {
+			cfg := defaultConfig
+			cfg.CAFile = lcfg.CertFile
+			cfg.ServerName = "other.test"
+			_, err := NewDialerWithConfig("127.0.0.1:2003", cfg).Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test pinned fingerprint", func() {
+			certPEM, err := os.ReadFile(lcfg.CertFile)
+			convey.So(err, convey.ShouldBeNil)
+			block, _ := pem.Decode(certPEM)
+			cert, err := x509.ParseCertificate(block.Bytes)
+			convey.So(err, convey.ShouldBeNil)
+
+			cfg := defaultConfig
+			cfg.Fingerprints = []string{optw.Fingerprint(cert)}
+			conn, err := NewDialerWithConfig("127.0.0.1:2003", cfg).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+
+			cfg.Fingerprints = []string{strings.Repeat("00", 32)}
+			_, err = NewDialerWithConfig("127.0.0.1:2003", cfg).Dial()
+			convey.So(errors.Is(err, optw.ErrFingerprintMismatch), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test known hosts", func() {
+			knownHosts := filepath.Join(dir, "known_hosts")
+			err := os.WriteFile(knownHosts, []byte("127.0.0.1:2003 "+strings.Repeat("00", 32)+"\n"), 0600)
+			convey.So(err, convey.ShouldBeNil)
+
+			cfg := defaultConfig
+			cfg.KnownHosts = knownHosts
+			_, err = NewDialerWithConfig("127.0.0.1:2003", cfg).Dial()
+			convey.So(errors.Is(err, optw.ErrFingerprintMismatch), convey.ShouldBeTrue)
+
+			// trusted on first use
+			cfg.KnownHosts = filepath.Join(dir, "tofu_known_hosts")
+			conn, err := NewDialerWithConfig("127.0.0.1:2003", cfg).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+			conn, err = NewDialerWithConfig("127.0.0.1:2003", cfg).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+		})
+
+		convey.Convey("test tls config and alpn", func() {
+			pool, err := optw.LoadCertPool(lcfg.CertFile)
+			convey.So(err, convey.ShouldBeNil)
+			d := NewDialer("127.0.0.1:2003")
+			d.SetTLSConfig(&tls.Config{RootCAs: pool, ServerName: "optw.test"})
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+
+			d.SetTLSConfig(&tls.Config{RootCAs: pool, ServerName: "optw.test", NextProtos: []string{"other"}})
+			_, err = d.Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQuicMutualTLS(t *testing.T) {
+	convey.Convey("test optw transport/quic mutual tls", t, func() {
+		dir := t.TempDir()
+		certPEM, keyPEM, err := optw.GenerateCertificate([]string{"client-1"})
+		convey.So(err, convey.ShouldBeNil)
+		clientCert := filepath.Join(dir, "client.pem")
+		clientKey := filepath.Join(dir, "client.key")
+		convey.So(os.WriteFile(clientCert, certPEM, 0600), convey.ShouldBeNil)
+		convey.So(os.WriteFile(clientKey, keyPEM, 0600), convey.ShouldBeNil)
+
+		lcfg := defaultConfig
+		lcfg.ClientCAFile = clientCert
+		l := NewListenerWithConfig("127.0.0.1:2004", lcfg)
+		infos := make(chan *optw.AuthInfo, 1)
+		l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+			infos <- info
+			return "tenant-" + info.Identity, nil
+		})
+		err = l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan optw.Conn, 1)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if err == nil {
+					accepted <- conn
+				}
+			}
+		}()
+
+		convey.Convey("test client certificate identity", func() {
+			cfg := testConfig
+			cfg.CertFile = clientCert
+			cfg.KeyFile = clientKey
+			conn, err := NewDialerWithConfig("127.0.0.1:2004", cfg).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			info := <-infos
+			convey.So(info.Identity, convey.ShouldEqual, "client-1")
+			convey.So(info.Certificate, convey.ShouldNotBeNil)
+			sconn := <-accepted
+			defer sconn.Close()
+			convey.So(sconn.Identity(), convey.ShouldEqual, "tenant-client-1")
+		})
+
+		convey.Convey("test client without certificate", func() {
+			// with tls 1.3 the server rejects the client after the dial
+			conn, err := newTestDialer("127.0.0.1:2004").Dial()
+			if err == nil {
+				_, err = conn.AcceptStream()
+			}
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test client certificate with token", func() {
+			l.SetAccessToken("test auth")
+			cfg := testConfig
+			cfg.CertFile = clientCert
+			cfg.KeyFile = clientKey
+			d := NewDialerWithConfig("127.0.0.1:2004", cfg)
+			d.SetAccessToken("test auth")
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			info := <-infos
+			convey.So(info.Token, convey.ShouldEqual, "test auth")
+			convey.So(info.Identity, convey.ShouldEqual, "client-1")
+			sconn := <-accepted
+			defer sconn.Close()
+			convey.So(sconn.Identity(), convey.ShouldEqual, "tenant-client-1")
+		})
+	})
+}
+
+func TestQuicPersistentConn(t *testing.T) {
+	convey.Convey("test optw persistent conn over quic", t, func() {
+		l := NewListener("127.0.0.1:3447")
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan optw.Conn, 2)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if err == nil {
+					accepted <- conn
+				}
+			}
+		}()
+
+		states := make(chan optw.ConnState, 16)
+		conn := optw.NewPersistentConn(newTestDialer("127.0.0.1:3447"), optw.PersistentConfig{
+			MinBackoff:    time.Millisecond * 10,
+			CheckInterval: time.Millisecond * 10,
+			OnStateChange: func(state optw.ConnState, err error) {
+				states <- state
+			},
+		})
+		defer conn.Close()
+		next := func() optw.ConnState {
+			select {
+			case state := <-states:
+				return state
+			case <-time.After(time.Second * 5):
+				return optw.ConnState(-1)
+			}
+		}
+		convey.So(next(), convey.ShouldEqual, optw.StateConnected)
+
+		// the server side dies without any stream open
+		sconn := <-accepted
+		sconn.Close()
+		convey.So(next(), convey.ShouldEqual, optw.StateDisconnected)
+		convey.So(next(), convey.ShouldEqual, optw.StateConnected)
+		sconn = <-accepted
+		defer sconn.Close()
 	})
 }
@@ -10,6 +10,16 @@ type Stream struct {
 	quic_go.Stream
 }
 
+func (s *Stream) Read(buf []byte) (int, error) {
+	n, err := s.Stream.Read(buf)
+	return n, mapError(err)
+}
+
+func (s *Stream) Write(buf []byte) (int, error) {
+	n, err := s.Stream.Write(buf)
+	return n, mapError(err)
+}
+
 func (s *Stream) RemoteAddr() net.Addr {
 	return s.rawConn.RemoteAddr()
 }
@@ -0,0 +1,84 @@
+package optw
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ListenerFactory creates a listener for addr, cfg is the transport
+// specific configuration.
+// The returned listener is not listening yet.
+type ListenerFactory func(addr string, cfg Config) (Listener, error)
+
+// DialerFactory creates a dialer for addr, cfg is the transport
+// specific configuration.
+type DialerFactory func(addr string, cfg Config) (Dialer, error)
+
+type transport struct {
+	listenerFactory ListenerFactory
+	dialerFactory   DialerFactory
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]transport)
+)
+
+// Register makes a transport available by scheme.
+// Either factory may be nil if the transport only supports one side.
+// Register panics if both factories are nil or the scheme is registered twice.
+func Register(scheme string, lf ListenerFactory, df DialerFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if lf == nil && df == nil {
+		panic("optw: Register factories are nil")
+	}
+	if _, dup := registry[scheme]; dup {
+		panic(fmt.Sprintf("optw: Register called twice for scheme %s", scheme))
+	}
+	registry[scheme] = transport{listenerFactory: lf, dialerFactory: df}
+}
+
+// RegisterConfig registers a transport whose listeners and dialers are
+// created from their configs, cfg is decoded over the defaults.
+func RegisterConfig[C any, L Listener, D Dialer](scheme string, defaults C,
+	newListener func(addr string, cfg C) L, newDialer func(addr string, cfg C) D) {
+	Register(scheme,
+		func(addr string, cfg Config) (Listener, error) {
+			c := defaults
+			err := cfg.Decode(&c)
+			if err != nil {
+				return nil, err
+			}
+			return newListener(addr, c), nil
+		},
+		func(addr string, cfg Config) (Dialer, error) {
+			c := defaults
+			err := cfg.Decode(&c)
+			if err != nil {
+				return nil, err
+			}
+			return newDialer(addr, c), nil
+		})
+}
+
+// Lookup returns the factories registered for scheme
+func Lookup(scheme string) (ListenerFactory, DialerFactory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	t, ok := registry[scheme]
+	return t.listenerFactory, t.dialerFactory, ok
+}
+
+// Schemes returns a sorted list of the registered schemes
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
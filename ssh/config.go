@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"time"
+
+	"github.com/ICKelin/optw"
+)
+
+type Config struct {
+	// ssh user of the dialer
+	User string `json:"user"`
+	// private key file of the dialer for public key auth
+	KeyFile string `json:"keyFile"`
+	// sha256 fingerprints of the server host key, eg: SHA256:xxx
+	HostKeys []string `json:"hostKeys"`
+	// openssh known_hosts file verifying the server host key
+	KnownHosts string `json:"knownHosts"`
+	// accept any server host key without hostKeys and knownHosts
+	InsecureIgnoreHostKey bool `json:"insecureIgnoreHostKey"`
+
+	// private key file of the listener host key
+	HostKeyFile string `json:"hostKeyFile"`
+	// generate an ed25519 host key into HostKeyFile if it does not exist
+	GenerateHostKey bool `json:"generateHostKey"`
+	// openssh authorized_keys file of the clients allowed by public key
+	AuthorizedKeys string `json:"authorizedKeys"`
+
+	// keepalive in seconds, 0 disables it
+	KeepAliveInterval int `json:"keepAliveInterval"`
+	KeepAliveTimeout  int `json:"keepAliveTimeout"`
+	optw.HandshakeConfig
+	optw.ProxyConfig
+}
+
+var defaultConfig = Config{
+	User:              "optw",
+	KeepAliveInterval: 3,
+	KeepAliveTimeout:  10,
+	HandshakeConfig:   optw.DefaultHandshakeConfig,
+}
+
+// DefaultConfig returns the default config
+func DefaultConfig() Config {
+	return defaultConfig
+}
+
+// keepAlive returns the keepalive interval and timeout,
+// the keepalive options take precedence over the configured ones.
+// without timeout the peer has an interval to reply.
+func (c Config) keepAlive(opts optw.Options) (time.Duration, time.Duration) {
+	interval, timeout := opts.KeepAlive(
+		time.Second*time.Duration(c.KeepAliveInterval),
+		time.Second*time.Duration(c.KeepAliveTimeout))
+	if timeout <= 0 {
+		timeout = interval
+	}
+	return interval, timeout
+}
@@ -0,0 +1,205 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// channel type of the optw streams, other channels are rejected
+	streamChannel = "optw-stream"
+	// global request carrying the client metadata
+	metadataRequest  = "optw-metadata@ickelin"
+	keepAliveRequest = "keepalive@ickelin"
+)
+
+var _ optw.Conn = &Conn{}
+
+// acceptBacklog is the number of accepted streams waiting for AcceptStream
+const acceptBacklog = 1024
+
+type Conn struct {
+	conn     gossh.Conn
+	streams  chan *Stream
+	identity interface{}
+	metadata map[string]string
+
+	mu       sync.Mutex
+	deadline time.Time
+	done     chan struct{}
+}
+
+func newConn(conn gossh.Conn, chans <-chan gossh.NewChannel, cfg Config, opts optw.Options) *Conn {
+	c := &Conn{
+		conn:    conn,
+		streams: make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		conn.Wait()
+		close(c.done)
+	}()
+	go c.acceptLoop(chans)
+
+	interval, timeout := cfg.keepAlive(opts)
+	if interval > 0 {
+		go c.keepalive(interval, timeout)
+	}
+	return c
+}
+
+// keepalive closes the connection once the peer does not reply in timeout
+func (c *Conn) keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := c.conn.SendRequest(keepAliveRequest, true, nil)
+			replied <- err
+		}()
+
+		timer := time.NewTimer(timeout)
+		select {
+		case err := <-replied:
+			timer.Stop()
+			if err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-timer.C:
+			c.conn.Close()
+			return
+		case <-c.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// acceptLoop confirms the channels opened by the peer as smux does
+// with its streams, OpenChannel blocks until the channel is confirmed.
+func (c *Conn) acceptLoop(chans <-chan gossh.NewChannel) {
+	for nc := range chans {
+		if nc.ChannelType() != streamChannel {
+			nc.Reject(gossh.UnknownChannelType, fmt.Sprintf("unknown channel type %s", nc.ChannelType()))
+			continue
+		}
+
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go gossh.DiscardRequests(reqs)
+
+		select {
+		case c.streams <- newStream(ch, c):
+		case <-c.done:
+			ch.Close()
+		}
+	}
+}
+
+func (c *Conn) OpenStream() (optw.Stream, error) {
+	ch, reqs, err := c.conn.OpenChannel(streamChannel, nil)
+	if err != nil {
+		return nil, c.streamError(err)
+	}
+	go gossh.DiscardRequests(reqs)
+
+	return newStream(ch, c), nil
+}
+
+// OpenStreamContext gives up waiting for the peer to confirm
+// the channel once ctx is done
+func (c *Conn) OpenStreamContext(ctx context.Context) (optw.Stream, error) {
+	return optw.OpenStreamContext(ctx, c.OpenStream)
+}
+
+func (c *Conn) AcceptStream() (optw.Stream, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+func (c *Conn) AcceptStreamContext(ctx context.Context) (optw.Stream, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case stream := <-c.streams:
+		return stream, nil
+	case <-c.done:
+		return nil, c.streamError(net.ErrClosed)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// streamError wraps errors of a dead connection with optw.ErrConnClosed
+func (c *Conn) streamError(err error) error {
+	if c.IsClosed() || optw.IsClosed(err) {
+		return optw.Wrap(optw.ErrConnClosed, err)
+	}
+	return err
+}
+
+// Close closes the connection and waits for its shutdown
+func (c *Conn) Close() {
+	c.conn.Close()
+	<-c.done
+}
+
+func (c *Conn) IsClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// SetDeadline sets the deadline of AcceptStream
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) Identity() interface{} {
+	return c.identity
+}
+
+func (c *Conn) Metadata() map[string]string {
+	return c.metadata
+}
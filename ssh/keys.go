@@ -0,0 +1,134 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"net"
+	"os"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKey loads the listener host key, an ephemeral one without file
+func (c Config) hostKey() (gossh.Signer, error) {
+	if len(c.HostKeyFile) <= 0 {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return gossh.NewSignerFromKey(key)
+	}
+
+	if c.GenerateHostKey {
+		_, err := os.Stat(c.HostKeyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			err = GenerateKey(c.HostKeyFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return loadKey(c.HostKeyFile)
+}
+
+// authorizedKeys loads the authorized_keys file, nil without file
+func (c Config) authorizedKeys() (map[string]bool, error) {
+	if len(c.AuthorizedKeys) <= 0 {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(c.AuthorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for len(bytes.TrimSpace(content)) > 0 {
+		key, _, _, rest, err := gossh.ParseAuthorizedKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("ssh: parse %s fail: %w", c.AuthorizedKeys, err)
+		}
+		keys[string(key.Marshal())] = true
+		content = rest
+	}
+	return keys, nil
+}
+
+var errNoHostKey = fmt.Errorf("ssh: no hostKeys or knownHosts " +
+	"to verify the server, set insecureIgnoreHostKey to skip the verification")
+
+// hostKeyCallback verifies the server host key by fingerprints
+// and known_hosts file, without them the dial fails unless
+// the verification is explicitly skipped.
+func (c Config) hostKeyCallback() (gossh.HostKeyCallback, error) {
+	if len(c.HostKeys) <= 0 && len(c.KnownHosts) <= 0 {
+		if !c.InsecureIgnoreHostKey {
+			return nil, errNoHostKey
+		}
+		return gossh.InsecureIgnoreHostKey(), nil
+	}
+
+	var knownHosts gossh.HostKeyCallback
+	if len(c.KnownHosts) > 0 {
+		cb, err := knownhosts.New(c.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		knownHosts = cb
+	}
+
+	pins := make(map[string]bool)
+	for _, fp := range c.HostKeys {
+		pins[fp] = true
+	}
+
+	return func(host string, remote net.Addr, key gossh.PublicKey) error {
+		fp := gossh.FingerprintSHA256(key)
+		if len(pins) > 0 && !pins[fp] {
+			return fmt.Errorf("%w: %s presented %s", optw.ErrFingerprintMismatch, host, fp)
+		}
+
+		if knownHosts != nil {
+			err := knownHosts(host, remote, key)
+			var keyErr *knownhosts.KeyError
+			if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+				return fmt.Errorf("%w: %s presented %s: %w", optw.ErrFingerprintMismatch, host, fp, err)
+			}
+			return err
+		}
+		return nil
+	}, nil
+}
+
+// GenerateKey writes a new ed25519 private key in openssh form to file
+func GenerateKey(file string) error {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	block, err := gossh.MarshalPrivateKey(key, "optw")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, pem.EncodeToMemory(block), 0600)
+}
+
+func loadKey(file string) (gossh.Signer, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := gossh.ParsePrivateKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: parse %s fail: %w", file, err)
+	}
+	return signer, nil
+}
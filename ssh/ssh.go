@@ -0,0 +1,328 @@
+// Package ssh runs optw over ssh, streams are ssh channels.
+// The access token is the ssh password, the listener also accepts
+// public keys of its authorized_keys file or of its auth handler.
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var _ optw.Listener = &Listener{}
+var _ optw.Dialer = &Dialer{}
+
+const scheme = "ssh"
+
+// ssh permission extensions of the client credentials
+const (
+	extToken = "optw-token"
+	extKey   = "optw-key"
+)
+
+func init() {
+	optw.RegisterConfig(scheme, defaultConfig, NewListenerWithConfig, NewDialerWithConfig)
+}
+
+type Dialer struct {
+	remote      string
+	config      Config
+	accessToken string
+	metadata    map[string]string
+	options     optw.Options
+}
+
+func NewDialer(remote string) *Dialer {
+	return NewDialerWithConfig(remote, defaultConfig)
+}
+
+func NewDialerWithConfig(remote string, cfg Config) *Dialer {
+	return &Dialer{remote: remote, config: cfg}
+}
+
+// SetAccessToken sets the token sent as ssh password
+func (d *Dialer) SetAccessToken(accessToken string) {
+	d.accessToken = accessToken
+}
+
+func (d *Dialer) SetMetadata(md map[string]string) {
+	d.metadata = md
+}
+
+// SetOptions sets the options shared by the transports
+func (d *Dialer) SetOptions(opts ...optw.Option) {
+	d.options.Apply(opts...)
+	d.config.HandshakeConfig = d.options.Handshake(d.config.HandshakeConfig)
+}
+
+func (d *Dialer) Dial() (optw.Conn, error) {
+	return d.DialContext(context.Background())
+}
+
+func (d *Dialer) DialContext(ctx context.Context) (optw.Conn, error) {
+	hostKeyCallback, err := d.config.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []gossh.AuthMethod
+	if len(d.config.KeyFile) > 0 {
+		signer, err := loadKey(d.config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, gossh.PublicKeys(signer))
+	}
+	if len(d.accessToken) > 0 {
+		auth = append(auth, gossh.Password(d.accessToken))
+	}
+
+	metadata, err := json.Marshal(d.metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := d.options.NetDialer("tcp")
+	if err != nil {
+		return nil, err
+	}
+	if dialer.Timeout <= 0 {
+		dialer.Timeout = d.config.Timeout()
+	}
+	var raw net.Conn
+	if d.config.ProxyEnabled() {
+		raw, err = d.config.ProxyDial(ctx, dialer, d.remote, d.config.Timeout())
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", d.remote)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, release := optw.WithContext(ctx, raw)
+
+	// the user auth runs once the host key is verified
+	var verified atomic.Bool
+	deadline := time.Now().Add(d.config.Timeout())
+	conn.SetDeadline(deadline)
+	sconn, chans, reqs, err := gossh.NewClientConn(conn, d.remote, &gossh.ClientConfig{
+		User: d.config.User,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			err := hostKeyCallback(hostname, remote, key)
+			verified.Store(err == nil)
+			return err
+		},
+	})
+	if err != nil {
+		conn.Close()
+		if verified.Load() && isAuthError(err) {
+			err = optw.Wrap(optw.ErrAuthFailed, err)
+		}
+		return nil, optw.ContextError(ctx, optw.HandshakeError(err, deadline))
+	}
+	go gossh.DiscardRequests(reqs)
+
+	// the server runs its auth handler on the metadata
+	ok, _, err := sconn.SendRequest(metadataRequest, true, metadata)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		sconn.Close()
+		return nil, optw.ContextError(ctx, optw.HandshakeError(err, deadline))
+	}
+	if !ok {
+		sconn.Close()
+		return nil, fmt.Errorf("%w: rejected by the server", optw.ErrAuthFailed)
+	}
+	err = release()
+	if err != nil {
+		sconn.Close()
+		return nil, err
+	}
+
+	c := newConn(sconn, chans, d.config, d.options)
+	c.metadata = d.metadata
+	return c, nil
+}
+
+// isAuthError reports whether err of the user auth is the rejection
+// of the credentials by the server rather than a transport error
+func isAuthError(err error) bool {
+	var netErr net.Error
+	return !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.As(err, &netErr)
+}
+
+type Listener struct {
+	laddr        string
+	config       Config
+	serverConfig *gossh.ServerConfig
+	options      optw.Options
+	net.Listener
+	optw.ServerAuth
+	acceptor *optw.Acceptor
+}
+
+func NewListener(laddr string) *Listener {
+	return NewListenerWithConfig(laddr, defaultConfig)
+}
+
+func NewListenerWithConfig(laddr string, cfg Config) *Listener {
+	return &Listener{laddr: laddr, config: cfg}
+}
+
+// SetOptions sets the options shared by the transports,
+// it takes effect on Listen
+func (l *Listener) SetOptions(opts ...optw.Option) {
+	l.options.Apply(opts...)
+	l.config.HandshakeConfig = l.options.Handshake(l.config.HandshakeConfig)
+}
+
+func (l *Listener) Listen() error {
+	hostKey, err := l.config.hostKey()
+	if err != nil {
+		return err
+	}
+
+	authorized, err := l.config.authorizedKeys()
+	if err != nil {
+		return err
+	}
+
+	conf := &gossh.ServerConfig{
+		NoClientAuth: true,
+		NoClientAuthCallback: func(gossh.ConnMetadata) (*gossh.Permissions, error) {
+			if l.ServerAuth.Enabled() || authorized != nil {
+				return nil, fmt.Errorf("auth required")
+			}
+			return &gossh.Permissions{}, nil
+		},
+		// the password is the access token, or the credential the auth
+		// handler checks, a keys only listener takes no password
+		PasswordCallback: func(meta gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			if !l.ServerAuth.TokenEnabled() && !l.ServerAuth.HandlerEnabled() {
+				return nil, fmt.Errorf("password auth disabled")
+			}
+			if !l.ServerAuth.VerifyToken(string(password)) {
+				return nil, fmt.Errorf("verify password fail")
+			}
+			return &gossh.Permissions{Extensions: map[string]string{extToken: string(password)}}, nil
+		},
+		// keys of the authorized_keys file, or any key for the auth handler
+		PublicKeyCallback: func(meta gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if !authorized[string(key.Marshal())] &&
+				(authorized != nil || !l.ServerAuth.HandlerEnabled()) {
+				return nil, fmt.Errorf("unknown public key")
+			}
+			return &gossh.Permissions{Extensions: map[string]string{extKey: gossh.FingerprintSHA256(key)}}, nil
+		},
+	}
+	conf.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", l.laddr)
+	if err != nil {
+		return err
+	}
+
+	l.serverConfig = conf
+	l.Listener = listener
+	l.acceptor = optw.NewAcceptor(l.config.Concurrency())
+	go l.acceptor.Serve(l.accept)
+	return nil
+}
+
+// Accept returns the next connection which passed the handshake,
+// a failed handshake is returned as error and the listener keeps accepting.
+func (l *Listener) Accept() (optw.Conn, error) {
+	return l.acceptor.Accept()
+}
+
+func (l *Listener) AcceptContext(ctx context.Context) (optw.Conn, error) {
+	return l.acceptor.AcceptContext(ctx)
+}
+
+func (l *Listener) accept() (func() (optw.Conn, error), error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (optw.Conn, error) {
+		return l.handshake(conn)
+	}, nil
+}
+
+func (l *Listener) handshake(conn net.Conn) (optw.Conn, error) {
+	deadline := time.Now().Add(l.config.Timeout())
+	conn.SetDeadline(deadline)
+	sconn, chans, reqs, err := gossh.NewServerConn(conn, l.serverConfig)
+	if err != nil {
+		conn.Close()
+		var authErr *gossh.ServerAuthError
+		if errors.As(err, &authErr) {
+			err = optw.Wrap(optw.ErrAuthFailed, err)
+		}
+		return nil, fmt.Errorf("auth fail: %w", optw.HandshakeError(err, deadline))
+	}
+
+	info := &optw.AuthInfo{
+		RemoteAddr: conn.RemoteAddr(),
+		Scheme:     scheme,
+		Token:      sconn.Permissions.Extensions[extToken],
+		Identity:   sconn.Permissions.Extensions[extKey],
+	}
+	identity, err := l.verifyMetadata(reqs, info)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		sconn.Close()
+		return nil, fmt.Errorf("auth fail: %w", optw.HandshakeError(err, deadline))
+	}
+	go gossh.DiscardRequests(reqs)
+
+	c := newConn(sconn, chans, l.config, l.options)
+	c.identity = identity
+	c.metadata = info.Metadata
+	return c, nil
+}
+
+// verifyMetadata waits for the client metadata and runs the auth handler,
+// its reply tells the client whether it is accepted.
+func (l *Listener) verifyMetadata(reqs <-chan *gossh.Request, info *optw.AuthInfo) (interface{}, error) {
+	for req := range reqs {
+		if req.Type != metadataRequest {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		var md map[string]string
+		err := json.Unmarshal(req.Payload, &md)
+		if err != nil {
+			req.Reply(false, nil)
+			return nil, fmt.Errorf("decode metadata fail: %w", err)
+		}
+
+		info.Metadata = md
+		identity, err := optw.VerifyPeer(&l.ServerAuth, info)
+		req.Reply(err == nil, nil)
+		return identity, err
+	}
+	return nil, fmt.Errorf("read metadata fail: %w", net.ErrClosed)
+}
+
+func (l *Listener) Close() error {
+	if l.acceptor != nil {
+		l.acceptor.Close()
+	}
+	if l.Listener == nil {
+		return nil
+	}
+	return l.Listener.Close()
+}
@@ -0,0 +1,213 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func acceptLoop(l *Listener) (chan optw.Conn, chan error) {
+	conns := make(chan optw.Conn, 4)
+	errs := make(chan error, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				errs <- err
+				continue
+			}
+			conns <- conn
+		}
+	}()
+	return conns, errs
+}
+
+// testConfig skips the host key verification of the ephemeral test keys
+func testConfig() Config {
+	cfg := defaultConfig
+	cfg.InsecureIgnoreHostKey = true
+	return cfg
+}
+
+func TestSSH(t *testing.T) {
+	convey.Convey("test optw transport/ssh", t, func() {
+		dir := t.TempDir()
+		lcfg := defaultConfig
+		lcfg.HostKeyFile = filepath.Join(dir, "host_key")
+		lcfg.GenerateHostKey = true
+		l := NewListenerWithConfig("127.0.0.1:2009", lcfg)
+		l.SetAccessToken("test auth")
+		l.SetAuthHandler(func(info *optw.AuthInfo) (interface{}, error) {
+			if info.Metadata["clientId"] == "banned" {
+				return nil, fmt.Errorf("banned client")
+			}
+			return info.Metadata["clientId"], nil
+		})
+		err := l.Listen()
+		convey.So(err, convey.ShouldBeNil)
+		defer l.Close()
+		conns, errs := acceptLoop(l)
+
+		hostKey, err := loadKey(lcfg.HostKeyFile)
+		convey.So(err, convey.ShouldBeNil)
+
+		convey.Convey("test password auth and streams", func() {
+			cfg := defaultConfig
+			cfg.HostKeys = []string{gossh.FingerprintSHA256(hostKey.PublicKey())}
+			d := NewDialerWithConfig("127.0.0.1:2009", cfg)
+			d.SetAccessToken("test auth")
+			d.SetMetadata(map[string]string{"clientId": "client-1"})
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn := <-conns
+			defer sconn.Close()
+			convey.So(sconn.Identity(), convey.ShouldEqual, "client-1")
+			convey.So(sconn.Metadata()["clientId"], convey.ShouldEqual, "client-1")
+
+			stream, err := conn.OpenStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer stream.Close()
+			stream.Write([]byte("ping"))
+
+			sstream, err := sconn.AcceptStream()
+			convey.So(err, convey.ShouldBeNil)
+			defer sstream.Close()
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(sstream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "ping")
+
+			sstream.Write([]byte("pong"))
+			_, err = io.ReadFull(stream, buf)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(buf), convey.ShouldEqual, "pong")
+
+			stream.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+			_, err = stream.Read(buf)
+			convey.So(optw.IsTimeout(err), convey.ShouldBeTrue)
+
+			sconn.SetDeadline(time.Now().Add(time.Millisecond * 50))
+			_, err = sconn.AcceptStream()
+			convey.So(optw.IsTimeout(err), convey.ShouldBeTrue)
+
+			conn.Close()
+			convey.So(conn.IsClosed(), convey.ShouldBeTrue)
+			_, err = conn.OpenStream()
+			convey.So(errors.Is(err, optw.ErrConnClosed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test unknown host key", func() {
+			d := NewDialer("127.0.0.1:2009")
+			d.SetAccessToken("test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, errNoHostKey), convey.ShouldBeTrue)
+			select {
+			case err := <-errs:
+				t.Fatalf("unexpected server error %v", err)
+			case <-time.After(time.Millisecond * 50):
+			}
+		})
+
+		convey.Convey("test keepalive without timeout", func() {
+			cfg := defaultConfig
+			cfg.HostKeys = []string{gossh.FingerprintSHA256(hostKey.PublicKey())}
+			cfg.KeepAliveInterval = 0
+			cfg.KeepAliveTimeout = 0
+			d := NewDialerWithConfig("127.0.0.1:2009", cfg)
+			d.SetAccessToken("test auth")
+			d.SetOptions(optw.WithKeepAlive(time.Millisecond*20, 0))
+			interval, timeout := d.config.keepAlive(d.options)
+			convey.So(interval, convey.ShouldEqual, time.Millisecond*20)
+			convey.So(timeout, convey.ShouldEqual, time.Millisecond*20)
+
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+			sconn := <-conns
+			defer sconn.Close()
+
+			time.Sleep(time.Millisecond * 100)
+			convey.So(conn.IsClosed(), convey.ShouldBeFalse)
+		})
+
+		convey.Convey("test wrong password", func() {
+			d := NewDialerWithConfig("127.0.0.1:2009", testConfig())
+			d.SetAccessToken("invalid test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(<-errs, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test auth handler reject", func() {
+			d := NewDialerWithConfig("127.0.0.1:2009", testConfig())
+			d.SetAccessToken("test auth")
+			d.SetMetadata(map[string]string{"clientId": "banned"})
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+			convey.So(errors.Is(<-errs, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test host key mismatch", func() {
+			cfg := defaultConfig
+			cfg.HostKeys = []string{"SHA256:unknown"}
+			d := NewDialerWithConfig("127.0.0.1:2009", cfg)
+			d.SetAccessToken("test auth")
+			_, err := d.Dial()
+			convey.So(errors.Is(err, optw.ErrFingerprintMismatch), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test public key auth", func() {
+			clientKey := filepath.Join(dir, "client_key")
+			convey.So(GenerateKey(clientKey), convey.ShouldBeNil)
+			signer, err := loadKey(clientKey)
+			convey.So(err, convey.ShouldBeNil)
+			authorizedKeys := filepath.Join(dir, "authorized_keys")
+			err = os.WriteFile(authorizedKeys, gossh.MarshalAuthorizedKey(signer.PublicKey()), 0600)
+			convey.So(err, convey.ShouldBeNil)
+
+			kcfg := defaultConfig
+			kcfg.AuthorizedKeys = authorizedKeys
+			kl := NewListenerWithConfig("127.0.0.1:2010", kcfg)
+			err = kl.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer kl.Close()
+
+			cfg := testConfig()
+			cfg.KeyFile = clientKey
+			conn, err := NewDialerWithConfig("127.0.0.1:2010", cfg).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := kl.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			convey.So(sconn.Identity(), convey.ShouldEqual, gossh.FingerprintSHA256(signer.PublicKey()))
+
+			otherKey := filepath.Join(dir, "other_key")
+			convey.So(GenerateKey(otherKey), convey.ShouldBeNil)
+			cfg.KeyFile = otherKey
+			_, err = NewDialerWithConfig("127.0.0.1:2010", cfg).Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+
+			// a keys only listener takes no password
+			d := NewDialerWithConfig("127.0.0.1:2010", testConfig())
+			d.SetAccessToken("any password")
+			_, err = d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,213 @@
+package ssh
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Stream is an ssh channel, ssh channels have no deadlines
+// so reads and writes go through goroutines which deadlines can abandon.
+type Stream struct {
+	ch      gossh.Channel
+	rawConn *Conn
+
+	reads   chan []byte
+	readErr error
+	rbuf    []byte
+	writes  chan writeReq
+	done    chan struct{}
+	once    sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+type writeReq struct {
+	buf    []byte
+	result chan writeResult
+}
+
+type writeResult struct {
+	n   int
+	err error
+}
+
+func newStream(ch gossh.Channel, conn *Conn) *Stream {
+	s := &Stream{
+		ch:            ch,
+		rawConn:       conn,
+		reads:         make(chan []byte),
+		writes:        make(chan writeReq),
+		done:          make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+	go s.readLoop()
+	go s.writeLoop()
+	return s
+}
+
+func (s *Stream) readLoop() {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := s.ch.Read(buf)
+		if n > 0 {
+			select {
+			case s.reads <- buf[:n]:
+			case <-s.done:
+				return
+			}
+		}
+		if err != nil {
+			s.readErr = err
+			close(s.reads)
+			return
+		}
+	}
+}
+
+func (s *Stream) writeLoop() {
+	for {
+		select {
+		case req := <-s.writes:
+			n, err := s.ch.Write(req.buf)
+			req.result <- writeResult{n: n, err: err}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Stream) Read(buf []byte) (int, error) {
+	if len(s.rbuf) > 0 {
+		n := copy(buf, s.rbuf)
+		s.rbuf = s.rbuf[n:]
+		return n, nil
+	}
+
+	select {
+	case data, ok := <-s.reads:
+		if !ok {
+			return 0, s.readErr
+		}
+		n := copy(buf, data)
+		s.rbuf = data[n:]
+		return n, nil
+	case <-s.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-s.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// Write writes buf to the channel, a write abandoned by
+// its deadline is still sent in order.
+func (s *Stream) Write(buf []byte) (int, error) {
+	req := writeReq{buf: append([]byte(nil), buf...), result: make(chan writeResult, 1)}
+	select {
+	case s.writes <- req:
+	case <-s.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-s.done:
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case res := <-req.result:
+		return res.n, res.err
+	case <-s.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *Stream) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.ch.Close()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.rawConn.RemoteAddr()
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.rawConn.LocalAddr()
+}
+
+// deadline is a channel closed once the deadline passes,
+// the same as the one of net.Pipe
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// wait for the timer to close cancel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,347 @@
+package optw
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig is embedded in the configs of the tls based transports
+type TLSConfig struct {
+	// certificate and private key files in pem form,
+	// the client certificate of a dialer
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// generate a self-signed certificate into CertFile and KeyFile
+	// if they do not exist yet
+	GenerateCert bool `json:"generateCert"`
+	// ca certificates in pem form used to verify the server
+	CAFile string `json:"caFile"`
+	// ca certificates in pem form, a listener with it requires
+	// client certificates signed by them
+	ClientCAFile string `json:"clientCAFile"`
+	// server name sent as SNI and verified against the server certificate,
+	// a listener generates its certificate for it
+	ServerName string `json:"serverName"`
+	// skip the server verification
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+	// sha256 fingerprints of the server certificate or of its public key,
+	// hex with optional colons, the server must match one of them
+	Fingerprints []string `json:"fingerprints"`
+	// known hosts file, the fingerprint of a new server is trusted
+	// on first use and written there, later ones must match it
+	KnownHosts string `json:"knownHosts"`
+}
+
+// ServerTLS builds the listener tls config.
+// Without certificate files an ephemeral self-signed certificate is used.
+func (c TLSConfig) ServerTLS(nextProtos []string) (*tls.Config, error) {
+	cert, err := c.certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   nextProtos,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(c.ClientCAFile) > 0 {
+		pool, err := LoadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// ClientTLS builds the dialer tls config for the server at addr.
+// The server is verified once a CA file or a server name is configured,
+// the system roots are used without CA file.
+// Fingerprints and known hosts are checked in addition to the CA file,
+// without CA file they replace the chain verification.
+// Without any of them the dial fails unless InsecureSkipVerify is set.
+func (c TLSConfig) ClientTLS(addr string, nextProtos []string) (*tls.Config, error) {
+	pinned := len(c.Fingerprints) > 0 || len(c.KnownHosts) > 0
+	if !c.InsecureSkipVerify && !pinned && len(c.CAFile) <= 0 && len(c.ServerName) <= 0 {
+		return nil, errNoTrustAnchor
+	}
+
+	conf := &tls.Config{
+		ServerName: c.ServerName,
+		NextProtos: nextProtos,
+		MinVersion: tls.VersionTLS12,
+		InsecureSkipVerify: c.InsecureSkipVerify ||
+			(len(c.CAFile) <= 0 && (len(c.ServerName) <= 0 || pinned)),
+	}
+
+	if pinned {
+		host := addr
+		if len(c.ServerName) > 0 {
+			host = c.ServerName
+		}
+		conf.VerifyPeerCertificate = c.verifyFingerprint(host)
+	}
+
+	if len(conf.ServerName) <= 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		conf.ServerName = host
+	}
+
+	if len(c.CAFile) > 0 {
+		pool, err := LoadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+
+	if len(c.CertFile) > 0 || len(c.KeyFile) > 0 {
+		cert, err := c.certificate()
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+var errNoTrustAnchor = fmt.Errorf("tls: no caFile, serverName, fingerprints or knownHosts " +
+	"to verify the server, set insecureSkipVerify to skip the verification")
+
+func (c TLSConfig) verifyFingerprint(host string) func([][]byte, [][]*x509.Certificate) error {
+	pins := make(map[string]bool)
+	for _, fp := range c.Fingerprints {
+		pins[normalizeFingerprint(fp)] = true
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) <= 0 {
+			return fmt.Errorf("tls: no server certificate")
+		}
+
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		fp := Fingerprint(cert)
+		if len(pins) > 0 && !pins[fp] && !pins[certFingerprint(cert)] {
+			return fmt.Errorf("%w: %s presented %s", ErrFingerprintMismatch, host, fp)
+		}
+
+		if len(c.KnownHosts) > 0 {
+			return checkKnownHost(c.KnownHosts, host, fp)
+		}
+		return nil
+	}
+}
+
+// Fingerprint returns the hex sha256 of the certificate public key,
+// it is stable across certificate renewals with the same key.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(strings.TrimSpace(fp))
+	fp = strings.TrimPrefix(fp, "sha256:")
+	return strings.ReplaceAll(fp, ":", "")
+}
+
+var knownHostsMu sync.Mutex
+
+// checkKnownHost compares fp with the known one of host,
+// an unknown host is appended to the file.
+// The file holds one "host fingerprint" per line, # starts a comment.
+func checkKnownHost(file, host, fp string) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	content, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || fields[0] != host {
+			continue
+		}
+
+		if normalizeFingerprint(fields[1]) != fp {
+			return fmt.Errorf("%w: %s presented %s, known %s", ErrFingerprintMismatch, host, fp, fields[1])
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s %s\n", host, fp)
+	return err
+}
+
+func (c TLSConfig) certificate() (tls.Certificate, error) {
+	if len(c.CertFile) <= 0 && len(c.KeyFile) <= 0 {
+		certPEM, keyPEM, err := GenerateCertificate(c.hosts())
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+
+	if len(c.CertFile) <= 0 || len(c.KeyFile) <= 0 {
+		return tls.Certificate{}, fmt.Errorf("tls: certFile and keyFile must be both set")
+	}
+
+	if c.GenerateCert {
+		err := c.generateFiles()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("tls: load certificate fail: %w", err)
+	}
+	return cert, nil
+}
+
+// generateFiles writes a new certificate unless both files exist
+func (c TLSConfig) generateFiles() error {
+	_, certErr := os.Stat(c.CertFile)
+	_, keyErr := os.Stat(c.KeyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return certErr
+	}
+
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return keyErr
+	}
+
+	certPEM, keyPEM, err := GenerateCertificate(c.hosts())
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(c.KeyFile, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.CertFile, certPEM, 0644)
+}
+
+func (c TLSConfig) hosts() []string {
+	if len(c.ServerName) > 0 {
+		return []string{c.ServerName}
+	}
+	return []string{"localhost", "127.0.0.1", "::1"}
+}
+
+// PeerCertificate returns the verified client certificate of state,
+// nil if the client sent none or it was not verified
+func PeerCertificate(state tls.ConnectionState) *x509.Certificate {
+	if len(state.VerifiedChains) <= 0 || len(state.PeerCertificates) <= 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// LoadCertPool loads the pem certificates of file
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("tls: no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+// GenerateCertificate creates a self-signed ECDSA P-256 certificate
+// for hosts, which can be used as its own CA file by the peers,
+// it is valid both as server and client certificate.
+func GenerateCertificate(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"optw"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,111 @@
+package optw
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	convey.Convey("test tls config", t, func() {
+		convey.Convey("test generated certificate is persisted", func() {
+			dir := t.TempDir()
+			cfg := TLSConfig{
+				CertFile:     filepath.Join(dir, "cert.pem"),
+				KeyFile:      filepath.Join(dir, "key.pem"),
+				GenerateCert: true,
+				ServerName:   "optw.test",
+			}
+			conf, err := cfg.ServerTLS(nil)
+			convey.So(err, convey.ShouldBeNil)
+			first := conf.Certificates[0].Certificate[0]
+
+			info, err := os.Stat(cfg.KeyFile)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Mode().Perm(), convey.ShouldEqual, os.FileMode(0600))
+
+			conf, err = cfg.ServerTLS(nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(conf.Certificates[0].Certificate[0], convey.ShouldResemble, first)
+
+			cert, err := x509.ParseCertificate(first)
+			convey.So(err, convey.ShouldBeNil)
+			_, ok := cert.PublicKey.(*ecdsa.PublicKey)
+			convey.So(ok, convey.ShouldBeTrue)
+			convey.So(cert.VerifyHostname("optw.test"), convey.ShouldBeNil)
+		})
+
+		convey.Convey("test missing certificate", func() {
+			dir := t.TempDir()
+			cfg := TLSConfig{
+				CertFile: filepath.Join(dir, "cert.pem"),
+				KeyFile:  filepath.Join(dir, "key.pem"),
+			}
+			_, err := cfg.ServerTLS(nil)
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test client verification", func() {
+			_, err := TLSConfig{}.ClientTLS("127.0.0.1:443", nil)
+			convey.So(err, convey.ShouldNotBeNil)
+
+			conf, err := TLSConfig{InsecureSkipVerify: true}.ClientTLS("127.0.0.1:443", nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(conf.InsecureSkipVerify, convey.ShouldBeTrue)
+
+			conf, err = TLSConfig{ServerName: "optw.test"}.ClientTLS("127.0.0.1:443", nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(conf.InsecureSkipVerify, convey.ShouldBeFalse)
+		})
+
+		convey.Convey("test fingerprints", func() {
+			certPEM, _, err := GenerateCertificate([]string{"optw.test"})
+			convey.So(err, convey.ShouldBeNil)
+			block, _ := pem.Decode(certPEM)
+			cert, err := x509.ParseCertificate(block.Bytes)
+			convey.So(err, convey.ShouldBeNil)
+			otherPEM, _, err := GenerateCertificate([]string{"optw.test"})
+			convey.So(err, convey.ShouldBeNil)
+			block, _ = pem.Decode(otherPEM)
+			other, err := x509.ParseCertificate(block.Bytes)
+			convey.So(err, convey.ShouldBeNil)
+
+			fp := Fingerprint(cert)
+			pinned := TLSConfig{Fingerprints: []string{"SHA256:" + strings.ToUpper(fp[:2]) + ":" + fp[2:]}}
+			verify := pinned.verifyFingerprint("optw.test")
+			convey.So(verify([][]byte{cert.Raw}, nil), convey.ShouldBeNil)
+			convey.So(errors.Is(verify([][]byte{other.Raw}, nil), ErrFingerprintMismatch), convey.ShouldBeTrue)
+
+			sum := sha256.Sum256(cert.Raw)
+			verify = TLSConfig{Fingerprints: []string{hex.EncodeToString(sum[:])}}.verifyFingerprint("optw.test")
+			convey.So(verify([][]byte{cert.Raw}, nil), convey.ShouldBeNil)
+		})
+
+		convey.Convey("test known hosts", func() {
+			certPEM, _, err := GenerateCertificate([]string{"optw.test"})
+			convey.So(err, convey.ShouldBeNil)
+			block, _ := pem.Decode(certPEM)
+			otherPEM, _, err := GenerateCertificate([]string{"optw.test"})
+			convey.So(err, convey.ShouldBeNil)
+			other, _ := pem.Decode(otherPEM)
+
+			cfg := TLSConfig{KnownHosts: filepath.Join(t.TempDir(), "known_hosts")}
+			verify := cfg.verifyFingerprint("optw.test:443")
+			convey.So(verify([][]byte{block.Bytes}, nil), convey.ShouldBeNil)
+			convey.So(verify([][]byte{block.Bytes}, nil), convey.ShouldBeNil)
+			convey.So(errors.Is(verify([][]byte{other.Bytes}, nil), ErrFingerprintMismatch), convey.ShouldBeTrue)
+
+			// other hosts are trusted on first use too
+			verify = cfg.verifyFingerprint("optw.test:8443")
+			convey.So(verify([][]byte{other.Bytes}, nil), convey.ShouldBeNil)
+		})
+	})
+}
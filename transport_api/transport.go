@@ -1,55 +1,107 @@
 package transport_api
 
 import (
-	"errors"
+	"fmt"
 	"github.com/ICKelin/optw"
-	kcp2 "github.com/ICKelin/optw/kcp"
-	"github.com/ICKelin/optw/mux"
-	"github.com/ICKelin/optw/quic"
-)
 
-const (
-	protoKCP    = "kcp"
-	protoTCPMux = "mux"
-	protoQuic   = "quic"
+	// register built-in transports
+	_ "github.com/ICKelin/optw/kcp"
+	_ "github.com/ICKelin/optw/mem"
+	_ "github.com/ICKelin/optw/mux"
+	_ "github.com/ICKelin/optw/quic"
+	_ "github.com/ICKelin/optw/ssh"
+	_ "github.com/ICKelin/optw/ws"
 )
 
-var (
-	errUnsupported = errors.New("transport_api: unsupported protocol")
-)
+// Register makes a transport available to NewListen and NewDialer by scheme.
+// It panics if both factories are nil or the scheme is registered twice.
+func Register(scheme string, lf optw.ListenerFactory, df optw.DialerFactory) {
+	optw.Register(scheme, lf, df)
+}
+
+// Schemes returns the sorted list of registered schemes
+func Schemes() []string {
+	return optw.Schemes()
+}
+
+func NewListen(scheme, addr, cfg string, opts ...optw.Option) (optw.Listener, error) {
+	return newListen(scheme, addr, optw.JSONConfig(cfg), opts)
+}
+
+func NewDialer(scheme, addr, cfg string, opts ...optw.Option) (optw.Dialer, error) {
+	return newDialer(scheme, addr, optw.JSONConfig(cfg), opts)
+}
+
+// NewListenEndpoint creates a listening listener from a URI form endpoint,
+// eg: kcp://0.0.0.0:5000?mtu=1200&token=xxx
+// the token param enables auth on the listener.
+func NewListenEndpoint(endpoint string, opts ...optw.Option) (optw.Listener, error) {
+	ep, err := optw.ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := newListen(ep.Scheme, ep.Addr, ep.Config(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	token := ep.Token()
+	if len(token) > 0 {
+		listener.SetAccessToken(token)
+	}
+	return listener, nil
+}
+
+// NewDialerEndpoint creates a dialer from a URI form endpoint,
+// eg: kcp://1.2.3.4:5000?mtu=1200&token=xxx
+func NewDialerEndpoint(endpoint string, opts ...optw.Option) (optw.Dialer, error) {
+	ep, err := optw.ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := newDialer(ep.Scheme, ep.Addr, ep.Config(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	token := ep.Token()
+	if len(token) > 0 {
+		dialer.SetAccessToken(token)
+	}
+	return dialer, nil
+}
+
+func newListen(scheme, addr string, cfg optw.Config, opts []optw.Option) (optw.Listener, error) {
+	lf, _, ok := optw.Lookup(scheme)
+	if !ok || lf == nil {
+		return nil, fmt.Errorf("%w: %s", optw.ErrUnsupportedScheme, scheme)
+	}
 
-func NewListen(scheme, addr, cfg string) (optw.Listener, error) {
-	var listener optw.Listener
-	switch scheme {
-	case protoKCP:
-		listener = kcp2.NewListener(addr, []byte(cfg))
-	case protoTCPMux:
-		listener = mux.NewListener(addr)
-	case protoQuic:
-		listener = quic.NewListener(addr)
-	default:
-		return nil, errUnsupported
+	listener, err := lf(addr, cfg)
+	if err != nil {
+		return nil, err
 	}
+	listener.SetOptions(opts...)
 
-	err := listener.Listen()
+	err = listener.Listen()
 	if err != nil {
 		return nil, err
 	}
 	return listener, nil
 }
 
-func NewDialer(scheme, addr, cfg string) (optw.Dialer, error) {
-	var dialer optw.Dialer
-	switch scheme {
-	case protoKCP:
-		dialer = kcp2.NewDialer(addr, []byte(cfg))
-	case protoTCPMux:
-		dialer = mux.NewDialer(addr)
-	case protoQuic:
-		dialer = quic.NewDialer(addr)
-	default:
-		return nil, errUnsupported
+func newDialer(scheme, addr string, cfg optw.Config, opts []optw.Option) (optw.Dialer, error) {
+	_, df, ok := optw.Lookup(scheme)
+	if !ok || df == nil {
+		return nil, fmt.Errorf("%w: %s", optw.ErrUnsupportedScheme, scheme)
 	}
 
+	dialer, err := df(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	dialer.SetOptions(opts...)
 	return dialer, nil
 }
@@ -0,0 +1,92 @@
+package transport_api
+
+import (
+	"errors"
+	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/mux"
+	"github.com/smartystreets/goconvey/convey"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	convey.Convey("test transport registry", t, func() {
+		convey.Convey("test built-in schemes", func() {
+			schemes := Schemes()
+			convey.So(schemes, convey.ShouldContain, "kcp")
+			convey.So(schemes, convey.ShouldContain, "mem")
+			convey.So(schemes, convey.ShouldContain, "mux")
+			convey.So(schemes, convey.ShouldContain, "mux+tls")
+			convey.So(schemes, convey.ShouldContain, "quic")
+			convey.So(schemes, convey.ShouldContain, "ssh")
+			convey.So(schemes, convey.ShouldContain, "ws")
+			convey.So(schemes, convey.ShouldContain, "wss")
+		})
+
+		convey.Convey("test custom scheme", func() {
+			Register("test-dial-only", nil, func(addr string, cfg optw.Config) (optw.Dialer, error) {
+				return mux.NewDialer(addr), nil
+			})
+			convey.So(Schemes(), convey.ShouldContain, "test-dial-only")
+
+			d, err := NewDialer("test-dial-only", "127.0.0.1:2001", "")
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(d, convey.ShouldNotBeNil)
+
+			_, err = NewListen("test-dial-only", "127.0.0.1:2001", "")
+			convey.So(errors.Is(err, optw.ErrUnsupportedScheme), convey.ShouldBeTrue)
+
+			convey.So(func() {
+				Register("test-dial-only", nil, func(addr string, cfg optw.Config) (optw.Dialer, error) {
+					return nil, nil
+				})
+			}, convey.ShouldPanic)
+		})
+
+		convey.Convey("test unsupported scheme", func() {
+			_, err := NewDialer("unknown", "127.0.0.1:2001", "")
+			convey.So(errors.Is(err, optw.ErrUnsupportedScheme), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test unix socket address", func() {
+			addr := "unix://" + filepath.Join(t.TempDir(), "optw.sock")
+			l, err := NewListen("mux", addr, `{"socketMode": "0660"}`)
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			d, err := NewDialer("mux", addr, "")
+			convey.So(err, convey.ShouldBeNil)
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+		})
+
+		convey.Convey("test endpoint", func() {
+			l, err := NewListenEndpoint("mem://test-endpoint?keepAliveInterval=1&token=test")
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					t.Error("err should be nil, got ", err)
+					return
+				}
+				conn.Close()
+			}()
+
+			d, err := NewDialerEndpoint("mem://test-endpoint?token=test")
+			convey.So(err, convey.ShouldBeNil)
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			conn.Close()
+
+			_, err = NewDialerEndpoint("mux://127.0.0.1:2001?mtu=1200")
+			convey.So(err, convey.ShouldNotBeNil)
+			_, err = NewDialerEndpoint("kcp://127.0.0.1:2001?mtu=abc")
+			convey.So(err, convey.ShouldNotBeNil)
+			_, err = NewDialerEndpoint("quic://127.0.0.1:2001?alpn=foo")
+			convey.So(err, convey.ShouldBeNil)
+		})
+	})
+}
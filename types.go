@@ -1,9 +1,7 @@
 package optw
 
 import (
-	"encoding/binary"
-	"fmt"
-	"io"
+	"context"
 	"net"
 	"time"
 )
@@ -11,7 +9,18 @@ import (
 // Dialer defines transport_api dialer for client side
 type Dialer interface {
 	Dial() (Conn, error)
+	// DialContext dials and runs the handshakes, it gives up
+	// once ctx is done or its deadline passes
+	DialContext(ctx context.Context) (Conn, error)
 	SetAccessToken(accessToken string)
+
+	// SetMetadata sets key/value metadata sent to the server
+	// in the auth handshake, eg: client id, version, capabilities.
+	// It requires an access token.
+	SetMetadata(md map[string]string)
+
+	// SetOptions sets the options shared by the transports
+	SetOptions(opts ...Option)
 }
 
 // Listener defines transport_api listener for server side
@@ -20,6 +29,8 @@ type Listener interface {
 	// Accept returns a connection
 	// if an error occurs, it may suit each implements error
 	Accept() (Conn, error)
+	// AcceptContext is Accept giving up once ctx is done
+	AcceptContext(ctx context.Context) (Conn, error)
 
 	// Close close a listener
 	Close() error
@@ -27,18 +38,49 @@ type Listener interface {
 	// Addr returns address of listener
 	Addr() net.Addr
 
+	// SetAccessToken enables the challenge-response auth handshake
+	SetAccessToken(token string)
+
+	// SetAuthFunc sets a check of the plaintext tokens, sent by legacy clients
+	// or by dialers with legacy auth enabled to a listener without access token
 	SetAuthFunc(func(token string) bool)
+
+	// SetAuthHandler sets the client authentication callback,
+	// the identity it returns is exposed by the accepted Conn
+	SetAuthHandler(AuthHandler)
+
+	// SetSecretFunc sets the lookup of per client secrets
+	// by the key id the clients send in their metadata
+	SetSecretFunc(SecretFunc)
+
+	// SetLegacyAuth accepts legacy plaintext token clients
+	// besides the challenge-response ones
+	SetLegacyAuth(enable bool)
+
+	// SetOptions sets the options shared by the transports,
+	// it takes effect on Listen
+	SetOptions(opts ...Option)
 }
 
 // Conn defines a transport_api connection
 type Conn interface {
 	OpenStream() (Stream, error)
 	AcceptStream() (Stream, error)
+	// OpenStreamContext and AcceptStreamContext give up once ctx is done
+	OpenStreamContext(ctx context.Context) (Stream, error)
+	AcceptStreamContext(ctx context.Context) (Stream, error)
 	Close()
 	IsClosed() bool
 	RemoteAddr() net.Addr
 	LocalAddr() net.Addr
 	SetDeadline(t time.Time) error
+
+	// Identity returns the identity from the listener's auth handler,
+	// nil on the client side or without auth handler
+	Identity() interface{}
+
+	// Metadata returns the metadata sent by the client in the auth handshake
+	Metadata() map[string]string
 }
 
 // Stream defines a transport_api stream base on
@@ -53,56 +95,3 @@ type Stream interface {
 	LocalAddr() net.Addr
 	SetDeadline(t time.Time) error
 }
-
-func AuthRequest(conn io.ReadWriter, token string) error {
-	hdr := make([]byte, 2)
-	binary.BigEndian.PutUint16(hdr, uint16(len(token)))
-	_, err := conn.Write(append(hdr, []byte(token)...))
-	if err != nil {
-		return err
-	}
-
-	// read auth reply
-	hdr = make([]byte, 2)
-	_, err = io.ReadFull(conn, hdr)
-	if err != nil {
-		return fmt.Errorf("read auth reply hdr fail: %v", err)
-	}
-
-	tokenLen := binary.BigEndian.Uint16(hdr)
-	tokenReply := make([]byte, tokenLen)
-	_, err = io.ReadFull(conn, tokenReply)
-	if err != nil {
-		return fmt.Errorf("read reply access token fail: %v", err)
-	}
-
-	if string(tokenReply) != token {
-		return fmt.Errorf("verify auth reply fail, expect %s got %s", token, tokenReply)
-	}
-	return nil
-}
-
-func VerifyAuth(conn io.ReadWriter, authFn func(token string) bool) error {
-	hdr := make([]byte, 2)
-	_, err := io.ReadFull(conn, hdr)
-	if err != nil {
-		return fmt.Errorf("read auth hdr fail: %v", err)
-	}
-
-	tokenLen := binary.BigEndian.Uint16(hdr)
-	token := make([]byte, tokenLen)
-	_, err = io.ReadFull(conn, token)
-	if err != nil {
-		return fmt.Errorf("read access token fail: %v", err)
-	}
-	ok := authFn(string(token))
-	if !ok {
-		return fmt.Errorf("verify token %s fail", token)
-	}
-
-	_, err = conn.Write(append(hdr, token...))
-	if err != nil {
-		return fmt.Errorf("write auth reply fail: %v", err)
-	}
-	return nil
-}
@@ -0,0 +1,97 @@
+package ws
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/internal/smuxconn"
+	"github.com/xtaci/smux"
+)
+
+type Config struct {
+	// http path of the websocket endpoint
+	Path string `json:"path"`
+	// Host header sent by the dialer, the dial address by default
+	Host string `json:"host"`
+	// extra http headers sent by the dialer
+	Headers map[string]string `json:"headers"`
+	// smux keepalive in seconds
+	KeepAliveInterval int `json:"keepAliveInterval"`
+	KeepAliveTimeout  int `json:"keepAliveTimeout"`
+	// websocket over tls, the default of wss
+	TLS bool `json:"tls"`
+	optw.HandshakeConfig
+	optw.TLSConfig
+	optw.ObfsConfig
+	optw.ProxyConfig
+}
+
+var defaultConfig = Config{
+	Path:              "/",
+	KeepAliveInterval: 3,
+	KeepAliveTimeout:  10,
+	HandshakeConfig:   optw.DefaultHandshakeConfig,
+}
+
+var defaultTLSConfig = Config{
+	Path:              "/",
+	KeepAliveInterval: 3,
+	KeepAliveTimeout:  10,
+	TLS:               true,
+	HandshakeConfig:   optw.DefaultHandshakeConfig,
+}
+
+// DefaultConfig returns the default config of scheme ws or wss
+func DefaultConfig(withTLS bool) Config {
+	if withTLS {
+		return defaultTLSConfig
+	}
+	return defaultConfig
+}
+
+func (c Config) scheme() string {
+	if c.TLS {
+		return tlsScheme
+	}
+	return scheme
+}
+
+func (c Config) path() string {
+	if !strings.HasPrefix(c.Path, "/") {
+		return "/" + c.Path
+	}
+	return c.Path
+}
+
+// tlsConfig returns conf, or the one built from the TLSConfig if conf is nil,
+// addr is the server address of a dialer and empty for a listener
+func (c Config) tlsConfig(conf *tls.Config, addr string) (*tls.Config, error) {
+	if conf != nil {
+		return conf, nil
+	}
+
+	if len(addr) <= 0 {
+		return c.ServerTLS(nil)
+	}
+	return c.ClientTLS(addr, nil)
+}
+
+// smuxConfig returns the smux config, the keepalive options
+// take precedence over the configured keepalive
+func (c Config) smuxConfig(opts optw.Options) *smux.Config {
+	return smuxconn.Config(
+		time.Second*time.Duration(c.KeepAliveInterval),
+		time.Second*time.Duration(c.KeepAliveTimeout), opts)
+}
+
+// splitAddr splits the path of an endpoint address, eg: host:80/tunnel
+func splitAddr(addr string, cfg Config) (string, Config) {
+	i := strings.Index(addr, "/")
+	if i < 0 {
+		return addr, cfg
+	}
+	cfg.Path = addr[i:]
+	return addr[:i], cfg
+}
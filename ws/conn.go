@@ -0,0 +1,44 @@
+package ws
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn is a websocket connection carrying binary frames,
+// it reports the tcp addresses instead of the websocket urls.
+type wsConn struct {
+	*websocket.Conn
+	local     net.Addr
+	remote    net.Addr
+	tlsState  *tls.ConnectionState
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newWSConn(ws *websocket.Conn, local, remote net.Addr) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{
+		Conn:   ws,
+		local:  local,
+		remote: remote,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.closed) })
+	return err
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
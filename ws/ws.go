@@ -0,0 +1,401 @@
+package ws
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/ICKelin/optw"
+	"github.com/ICKelin/optw/internal/smuxconn"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+	"golang.org/x/net/websocket"
+)
+
+var _ optw.Listener = &Listener{}
+var _ optw.Dialer = &Dialer{}
+var _ http.Handler = &Listener{}
+
+const (
+	scheme    = "ws"
+	tlsScheme = "wss"
+)
+
+func init() {
+	optw.RegisterConfig(scheme, defaultConfig, NewListenerWithConfig, NewDialerWithConfig)
+	optw.RegisterConfig(tlsScheme, defaultTLSConfig, NewListenerWithConfig, NewDialerWithConfig)
+}
+
+type Dialer struct {
+	remote      string
+	config      Config
+	tlsConfig   *tls.Config
+	accessToken string
+	metadata    map[string]string
+	options     optw.Options
+}
+
+// NewDialer creates a dialer of the websocket endpoint remote,
+// eg: 1.2.3.4:80/tunnel
+func NewDialer(remote string) *Dialer {
+	return NewDialerWithConfig(remote, defaultConfig)
+}
+
+func NewDialerWithConfig(remote string, cfg Config) *Dialer {
+	remote, cfg = splitAddr(remote, cfg)
+	return &Dialer{remote: remote, config: cfg}
+}
+
+func (d *Dialer) SetAccessToken(accessToken string) {
+	d.accessToken = accessToken
+}
+
+func (d *Dialer) SetMetadata(md map[string]string) {
+	d.metadata = md
+}
+
+// SetOptions sets the options shared by the transports
+func (d *Dialer) SetOptions(opts ...optw.Option) {
+	d.options.Apply(opts...)
+	d.config.HandshakeConfig = d.options.Handshake(d.config.HandshakeConfig)
+}
+
+// SetTLSConfig sets the tls config used by wss instead of the one
+// built from the CA file and server name
+func (d *Dialer) SetTLSConfig(conf *tls.Config) {
+	d.tlsConfig = conf
+}
+
+func (d *Dialer) Dial() (optw.Conn, error) {
+	return d.DialContext(context.Background())
+}
+
+func (d *Dialer) DialContext(ctx context.Context) (optw.Conn, error) {
+	dialer, err := d.options.NetDialer("tcp")
+	if err != nil {
+		return nil, err
+	}
+	if dialer.Timeout <= 0 {
+		dialer.Timeout = d.config.Timeout()
+	}
+	var raw net.Conn
+	if d.config.ProxyEnabled() {
+		raw, err = d.config.ProxyDial(ctx, dialer, d.remote, d.config.Timeout())
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", d.remote)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, release := optw.WithContext(ctx, raw)
+	rwc, err := d.handshake(conn)
+	if err != nil {
+		return nil, optw.ContextError(ctx, err)
+	}
+	err = release()
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+
+	mux, err := smux.Client(rwc, d.config.smuxConfig(d.options))
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+
+	return smuxconn.New(mux, nil, d.metadata), nil
+}
+
+// handshake runs the websocket, obfuscation and auth handshakes
+// over conn, conn is closed on failure
+func (d *Dialer) handshake(conn net.Conn) (net.Conn, error) {
+	ws, err := d.upgrade(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	rwc, err := d.obfs(ws)
+	if err != nil {
+		return nil, err
+	}
+
+	// enable auth
+	if len(d.accessToken) > 0 {
+		deadline := time.Now().Add(d.config.Timeout())
+		rwc.SetDeadline(deadline)
+		err = d.options.AuthRequest(rwc, d.accessToken, d.metadata)
+		rwc.SetDeadline(time.Time{})
+		if err != nil {
+			rwc.Close()
+			return nil, optw.HandshakeError(err, deadline)
+		}
+	}
+	return rwc, nil
+}
+
+// obfs runs the obfuscation handshake over the websocket if enabled,
+// ws is closed on failure
+func (d *Dialer) obfs(ws *wsConn) (net.Conn, error) {
+	if !d.config.ObfsEnabled() {
+		return ws, nil
+	}
+
+	deadline := time.Now().Add(d.config.Timeout())
+	ws.SetDeadline(deadline)
+	conn, err := d.config.ObfsClient(ws)
+	ws.SetDeadline(time.Time{})
+	if err != nil {
+		ws.Close()
+		return nil, optw.HandshakeError(err, deadline)
+	}
+	return conn, nil
+}
+
+// upgrade runs the tls and websocket handshakes over conn
+func (d *Dialer) upgrade(conn net.Conn) (*wsConn, error) {
+	host := d.config.Host
+	if len(host) <= 0 {
+		host = d.remote
+	}
+
+	rwc := conn
+	wsScheme, origin := "ws://", "http://"
+	if d.config.TLS {
+		conf, err := d.config.tlsConfig(d.tlsConfig, host)
+		if err != nil {
+			return nil, err
+		}
+		rwc = tls.Client(conn, conf)
+		wsScheme, origin = "wss://", "https://"
+	}
+
+	wsConfig, err := websocket.NewConfig(wsScheme+host+d.config.path(), origin+host)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range d.config.Headers {
+		wsConfig.Header.Set(k, v)
+	}
+
+	deadline := time.Now().Add(d.config.Timeout())
+	rwc.SetDeadline(deadline)
+	ws, err := websocket.NewClient(wsConfig, rwc)
+	rwc.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, optw.HandshakeError(fmt.Errorf("websocket handshake fail: %w", err), deadline)
+	}
+	return newWSConn(ws, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
+
+// Listener accepts websocket clients, either on its own http server
+// or as a http.Handler mounted on an existing one, see NewHandler.
+type Listener struct {
+	laddr     string
+	config    Config
+	tlsConfig *tls.Config
+	listener  net.Listener
+	server    *http.Server
+	conns     chan *wsConn
+	done      chan struct{}
+	closeOnce sync.Once
+	options   optw.Options
+	optw.ServerAuth
+	acceptor *optw.Acceptor
+}
+
+// NewListener creates a listener serving the websocket endpoint laddr,
+// eg: 0.0.0.0:80/tunnel
+func NewListener(laddr string) *Listener {
+	return NewListenerWithConfig(laddr, defaultConfig)
+}
+
+func NewListenerWithConfig(laddr string, cfg Config) *Listener {
+	laddr, cfg = splitAddr(laddr, cfg)
+	return &Listener{
+		laddr:  laddr,
+		config: cfg,
+		conns:  make(chan *wsConn),
+		done:   make(chan struct{}),
+	}
+}
+
+// NewHandler creates a listener without address to mount on an existing
+// http server, it accepts clients once returned.
+// The server terminates tls, the TLS config fields are not used.
+func NewHandler(cfg Config) *Listener {
+	l := NewListenerWithConfig("", cfg)
+	// without address Listen only starts accepting
+	l.Listen()
+	return l
+}
+
+// SetOptions sets the options shared by the transports,
+// it takes effect on Listen
+func (l *Listener) SetOptions(opts ...optw.Option) {
+	l.options.Apply(opts...)
+	l.config.HandshakeConfig = l.options.Handshake(l.config.HandshakeConfig)
+}
+
+// SetTLSConfig sets the tls config used by wss instead of the one
+// built from the certificate files, it takes effect on Listen
+func (l *Listener) SetTLSConfig(conf *tls.Config) {
+	l.tlsConfig = conf
+}
+
+func (l *Listener) Listen() error {
+	if len(l.laddr) > 0 {
+		listener, err := net.Listen("tcp", l.laddr)
+		if err != nil {
+			return err
+		}
+
+		if l.config.TLS {
+			conf, err := l.config.tlsConfig(l.tlsConfig, "")
+			if err != nil {
+				listener.Close()
+				return err
+			}
+			listener = tls.NewListener(listener, conf)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(l.config.path(), l)
+		l.listener = listener
+		l.server = &http.Server{Handler: mux, ReadHeaderTimeout: l.config.Timeout()}
+		go l.server.Serve(listener)
+	}
+
+	l.acceptor = optw.NewAcceptor(l.config.Concurrency())
+	go l.acceptor.Serve(l.accept)
+	return nil
+}
+
+// ServeHTTP upgrades the request to websocket and queues the client
+// for the handshake, the connection lives until the session is closed.
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server := websocket.Server{
+		// optw clients are not browsers, any origin is accepted
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.serve,
+	}
+	server.ServeHTTP(w, r)
+}
+
+func (l *Listener) serve(ws *websocket.Conn) {
+	r := ws.Request()
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		remote = nil
+	}
+
+	conn := newWSConn(ws, local, remote)
+	if remote == nil {
+		conn.remote = ws.RemoteAddr()
+	}
+	conn.tlsState = r.TLS
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		return
+	}
+	<-conn.closed
+}
+
+// Accept returns the next connection which passed the handshake,
+// a failed handshake is returned as error and the listener keeps accepting.
+func (l *Listener) Accept() (optw.Conn, error) {
+	return l.acceptor.Accept()
+}
+
+func (l *Listener) AcceptContext(ctx context.Context) (optw.Conn, error) {
+	return l.acceptor.AcceptContext(ctx)
+}
+
+func (l *Listener) accept() (func() (optw.Conn, error), error) {
+	select {
+	case conn := <-l.conns:
+		return func() (optw.Conn, error) {
+			return l.handshake(conn)
+		}, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) handshake(ws *wsConn) (optw.Conn, error) {
+	var identity interface{}
+	var err error
+	info := &optw.AuthInfo{RemoteAddr: ws.RemoteAddr(), Scheme: l.config.scheme()}
+	if ws.tlsState != nil {
+		info.Certificate = optw.PeerCertificate(*ws.tlsState)
+		if info.Certificate != nil {
+			info.Identity = optw.CertIdentity(info.Certificate)
+		}
+	}
+
+	var conn net.Conn = ws
+	if l.config.ObfsEnabled() {
+		deadline := time.Now().Add(l.config.Timeout())
+		ws.SetDeadline(deadline)
+		conn, err = l.config.ObfsServer(ws)
+		ws.SetDeadline(time.Time{})
+		if err != nil {
+			ws.Close()
+			return nil, fmt.Errorf("obfs handshake fail: %w", optw.HandshakeError(err, deadline))
+		}
+	}
+
+	// enable auth
+	switch {
+	case info.Certificate != nil && !l.ServerAuth.TokenEnabled():
+		identity, err = optw.VerifyPeer(&l.ServerAuth, info)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("auth fail: %w", err)
+		}
+	case l.ServerAuth.Enabled():
+		deadline := time.Now().Add(l.config.Timeout())
+		conn.SetDeadline(deadline)
+		identity, err = optw.VerifyAuth(conn, &l.ServerAuth, info)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("auth fail: %w", optw.HandshakeError(err, deadline))
+		}
+	}
+
+	mux, err := smux.Server(conn, l.config.smuxConfig(l.options))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return smuxconn.New(mux, identity, info.Metadata), nil
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	if l.acceptor != nil {
+		l.acceptor.Close()
+	}
+	if l.server != nil {
+		return l.server.Close()
+	}
+	return nil
+}
+
+// Addr returns the address of the own http server, nil for a handler
+func (l *Listener) Addr() net.Addr {
+	if l.listener == nil {
+		return nil
+	}
+	return l.listener.Addr()
+}
@@ -0,0 +1,184 @@
+package ws
+
+import (
+	"errors"
+	"github.com/ICKelin/optw"
+	"github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func echo(conn, sconn optw.Conn) {
+	stream, err := conn.OpenStream()
+	convey.So(err, convey.ShouldBeNil)
+	defer stream.Close()
+	stream.Write([]byte("ping"))
+
+	sstream, err := sconn.AcceptStream()
+	convey.So(err, convey.ShouldBeNil)
+	defer sstream.Close()
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(sstream, buf)
+	convey.So(err, convey.ShouldBeNil)
+	convey.So(string(buf), convey.ShouldEqual, "ping")
+}
+
+func TestWS(t *testing.T) {
+	convey.Convey("test optw transport/ws", t, func() {
+		convey.Convey("test listener", func() {
+			l := NewListener("127.0.0.1:2007/tunnel")
+			l.SetAccessToken("test auth")
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			d := NewDialer("127.0.0.1:2007/tunnel")
+			d.SetAccessToken("test auth")
+			d.SetMetadata(map[string]string{"clientId": "client-1"})
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			convey.So(sconn.Metadata()["clientId"], convey.ShouldEqual, "client-1")
+			convey.So(sconn.RemoteAddr().String(), convey.ShouldEqual, conn.LocalAddr().String())
+			echo(conn, sconn)
+		})
+
+		convey.Convey("test auth fail", func() {
+			l := NewListener("127.0.0.1:2007/tunnel")
+			l.SetAccessToken("test auth")
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			go func() {
+				_, err := l.Accept()
+				if !errors.Is(err, optw.ErrAuthFailed) {
+					t.Error("err should be ErrAuthFailed, got ", err)
+				}
+			}()
+
+			d := NewDialer("127.0.0.1:2007/tunnel")
+			d.SetAccessToken("invalid test auth")
+			_, err = d.Dial()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test wrong path", func() {
+			l := NewListener("127.0.0.1:2007/tunnel")
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			_, err = NewDialer("127.0.0.1:2007/other").Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test handler with host and headers", func() {
+			l := NewHandler(defaultConfig)
+			l.SetAccessToken("test auth")
+			defer l.Close()
+
+			headers := make(chan http.Header, 1)
+			hosts := make(chan string, 1)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/tunnel", func(w http.ResponseWriter, r *http.Request) {
+				headers <- r.Header
+				hosts <- r.Host
+				l.ServeHTTP(w, r)
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			cfg := defaultConfig
+			cfg.Host = "cdn.example.com"
+			cfg.Headers = map[string]string{"X-Tenant": "tenant-1"}
+			d := NewDialerWithConfig(strings.TrimPrefix(server.URL, "http://")+"/tunnel", cfg)
+			d.SetAccessToken("test auth")
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			convey.So((<-headers).Get("X-Tenant"), convey.ShouldEqual, "tenant-1")
+			convey.So(<-hosts, convey.ShouldEqual, "cdn.example.com")
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			echo(conn, sconn)
+		})
+
+		convey.Convey("test wss", func() {
+			lcfg := DefaultConfig(true)
+			lcfg.CertFile = filepath.Join(t.TempDir(), "cert.pem")
+			lcfg.KeyFile = filepath.Join(filepath.Dir(lcfg.CertFile), "key.pem")
+			lcfg.GenerateCert = true
+			l := NewListenerWithConfig("127.0.0.1:2008/tunnel", lcfg)
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			cfg := DefaultConfig(true)
+			cfg.CAFile = lcfg.CertFile
+			conn, err := NewDialerWithConfig("127.0.0.1:2008/tunnel", cfg).Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			echo(conn, sconn)
+
+			// a plain websocket client gets no upgrade
+			_, err = NewDialer("127.0.0.1:2008/tunnel").Dial()
+			convey.So(err, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("test obfuscation", func() {
+			lcfg := defaultConfig
+			lcfg.ObfsKey = "obfs key"
+			lcfg.HandshakeTimeout = 1
+			l := NewListenerWithConfig("127.0.0.1:2007/tunnel", lcfg)
+			l.SetAccessToken("test auth")
+			err := l.Listen()
+			convey.So(err, convey.ShouldBeNil)
+			defer l.Close()
+
+			d := NewDialerWithConfig("127.0.0.1:2007/tunnel", lcfg)
+			d.SetAccessToken("test auth")
+			conn, err := d.Dial()
+			convey.So(err, convey.ShouldBeNil)
+			defer conn.Close()
+
+			sconn, err := l.Accept()
+			convey.So(err, convey.ShouldBeNil)
+			defer sconn.Close()
+			echo(conn, sconn)
+
+			// the listener is silent without the key
+			cfg := lcfg
+			cfg.ObfsKey = "invalid key"
+			d = NewDialerWithConfig("127.0.0.1:2007/tunnel", cfg)
+			d.SetAccessToken("test auth")
+			_, err = d.Dial()
+			convey.So(errors.Is(err, optw.ErrHandshakeTimeout), convey.ShouldBeTrue)
+			_, err = l.Accept()
+			convey.So(errors.Is(err, optw.ErrAuthFailed), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("test accept after close", func() {
+			l := NewHandler(defaultConfig)
+			l.Close()
+			_, err := l.Accept()
+			convey.So(errors.Is(err, net.ErrClosed), convey.ShouldBeTrue)
+		})
+	})
+}